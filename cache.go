@@ -0,0 +1,210 @@
+package main
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "io"
+    "log/slog"
+    "net/http"
+    "os"
+    "path/filepath"
+    "time"
+)
+
+const (
+    defaultCacheDir = "cache"
+    // Default TTLs in minutes
+    defaultImageCacheTTL  = 24 * 60
+    defaultSearchCacheTTL = 10
+    // apiCacheKeep is how long expired entries are kept past their TTL, so
+    // they can still be revalidated with a conditional request.
+    apiCacheKeep = 7 * 24 * time.Hour
+)
+
+// apiCacheEndpoints are the cached endpoints; each has its own subdirectory.
+var apiCacheEndpoints = []string{"image", "search"}
+
+// apiCacheEntry is a cached API response body with its validators.
+type apiCacheEntry struct {
+    URL          string          `json:"url"`
+    Fetched      time.Time       `json:"fetched"`
+    ETag         string          `json:"etag,omitempty"`
+    LastModified string          `json:"last_modified,omitempty"`
+    Body         json.RawMessage `json:"body"`
+}
+
+func (cfg *Config) cacheDir() string {
+    if cfg.Cache.Dir != "" {
+        return cfg.Cache.Dir
+    }
+    return defaultCacheDir
+}
+
+// cacheTTL returns how long responses of the endpoint are fresh, or 0 if
+// they aren't cached.
+func (cfg *Config) cacheTTL(endpoint string) time.Duration {
+    if !cfg.Cache.Enabled {
+        return 0
+    }
+    minutes, def := cfg.Cache.ImageTTL, defaultImageCacheTTL
+    if endpoint == "search" {
+        minutes, def = cfg.Cache.SearchTTL, defaultSearchCacheTTL
+    }
+    if minutes < 0 {
+        return 0
+    }
+    if minutes == 0 {
+        minutes = def
+    }
+    return time.Duration(minutes) * time.Minute
+}
+
+// apiCachePath names the cache file of a URL. The API token is part of the
+// key because it decides which purities a response includes; it is hashed
+// so it never ends up on disk.
+func apiCachePath(cfg *Config, endpoint, api string) string {
+    sum := sha256.Sum256([]byte(cfg.Wallhaven.APIToken + "\n" + api))
+    return filepath.Join(cfg.cacheDir(), endpoint, hex.EncodeToString(sum[:])+".json")
+}
+
+// readAPICache returns the entry stored at path, or nil if there is none or
+// it can't be read.
+func readAPICache(path string) *apiCacheEntry {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil
+    }
+    var entry apiCacheEntry
+    if err := json.Unmarshal(data, &entry); err != nil {
+        slog.Warn("Ignoring unreadable API cache entry", "file", path, "error", err)
+        return nil
+    }
+    return &entry
+}
+
+// writeAPICache stores the entry through a temporary file, so concurrent
+// readers never see a partial one.
+func writeAPICache(path string, entry *apiCacheEntry) error {
+    data, err := json.Marshal(entry)
+    if err != nil {
+        return err
+    }
+    if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+        return err
+    }
+    tmp, err := os.CreateTemp(filepath.Dir(path), ".entry-*")
+    if err != nil {
+        return err
+    }
+    defer os.Remove(tmp.Name())
+    if _, err := tmp.Write(data); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err := tmp.Close(); err != nil {
+        return err
+    }
+    return os.Rename(tmp.Name(), path)
+}
+
+// cachedWallhavenGet returns the body of a Wallhaven API GET request. A fresh
+// cached copy is used as is; a stale one is revalidated with If-None-Match or
+// If-Modified-Since if the server sent validators. With ttl 0 the cache is
+// bypassed.
+func cachedWallhavenGet(cfg *Config, endpoint, api string, ttl time.Duration) ([]byte, error) {
+    var path string
+    var entry *apiCacheEntry
+    if ttl > 0 {
+        path = apiCachePath(cfg, endpoint, api)
+        entry = readAPICache(path)
+        if entry != nil && time.Since(entry.Fetched) < ttl {
+            wallhavenCacheRequests.WithLabelValues(endpoint, "hit").Inc()
+            slog.Debug("API cache hit", "endpoint", endpoint, "url", api, "age", time.Since(entry.Fetched).Round(time.Second))
+            return entry.Body, nil
+        }
+    }
+
+    req, _ := http.NewRequest("GET", api, nil)
+    setWallhavenHeaders(cfg, req)
+    if entry != nil {
+        if entry.ETag != "" {
+            req.Header.Set("If-None-Match", entry.ETag)
+        }
+        if entry.LastModified != "" {
+            req.Header.Set("If-Modified-Since", entry.LastModified)
+        }
+    }
+    resp, err := makeRateLimitedRequest(req, endpoint)
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode == http.StatusNotModified && entry != nil {
+        wallhavenCacheRequests.WithLabelValues(endpoint, "revalidated").Inc()
+        entry.Fetched = time.Now()
+    } else {
+        body, err := io.ReadAll(resp.Body)
+        if err != nil {
+            return nil, err
+        }
+        // Only complete JSON documents are worth keeping
+        if ttl <= 0 || !json.Valid(body) {
+            return body, nil
+        }
+        wallhavenCacheRequests.WithLabelValues(endpoint, "miss").Inc()
+        entry = &apiCacheEntry{
+            URL:          api,
+            Fetched:      time.Now(),
+            ETag:         resp.Header.Get("ETag"),
+            LastModified: resp.Header.Get("Last-Modified"),
+            Body:         body,
+        }
+    }
+    if err := writeAPICache(path, entry); err != nil {
+        slog.Warn("Could not write API cache entry", "endpoint", endpoint, "error", err)
+    }
+    return entry.Body, nil
+}
+
+// PruneAPICache removes cache entries that expired longer than apiCacheKeep
+// ago, once an hour.
+func PruneAPICache(state *liveState) {
+    for {
+        cfg := state.config()
+        if cfg.Cache.Enabled {
+            for _, endpoint := range apiCacheEndpoints {
+                dir := filepath.Join(cfg.cacheDir(), endpoint)
+                entries, err := os.ReadDir(dir)
+                if err != nil && !os.IsNotExist(err) {
+                    slog.Error("Could not list API cache", "dir", dir, "error", err)
+                }
+                maxAge := cfg.cacheTTL(endpoint) + apiCacheKeep
+                for _, entry := range entries {
+                    info, err := entry.Info()
+                    if err != nil || entry.IsDir() || time.Since(info.ModTime()) < maxAge {
+                        continue
+                    }
+                    if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil {
+                        slog.Error("Could not remove API cache entry", "file", entry.Name(), "error", err)
+                    }
+                }
+            }
+        }
+        time.Sleep(time.Hour)
+    }
+}
+
+// ClearAPICache implements "cache clear": it deletes every cached response,
+// whether or not the cache is enabled.
+func ClearAPICache(cfg *Config) error {
+    for _, endpoint := range apiCacheEndpoints {
+        dir := filepath.Join(cfg.cacheDir(), endpoint)
+        if err := os.RemoveAll(dir); err != nil {
+            return err
+        }
+    }
+    slog.Info("Cleared the API cache", "dir", cfg.cacheDir())
+    return nil
+}
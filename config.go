@@ -11,9 +11,28 @@ type Config struct {
                 ServerURL  string `yaml:"server_url"`
                 User       string `yaml:"user"`
                 Password   string `yaml:"password"`
-                RoomID     string `yaml:"room_id"`
-                TokenFile  string `yaml:"token_file"`
+                LoginToken string `yaml:"login_token"` // One-time m.login.token for SSO-only homeservers
+                RoomID     string `yaml:"room_id"` // Single room shorthand, used when Rooms is empty
+                Rooms      []MatrixRoomConfig `yaml:"rooms"`
+                AutoJoin   bool   `yaml:"auto_join"` // Accept room invites sent to the bot
+                TokenFile  string `yaml:"token_file"` // JSON credentials; older bare-token files are upgraded
                 Enabled    bool   `yaml:"enabled"` // Set to false to disable Matrix posting
+                Encryption struct {
+                        Enabled               bool   `yaml:"enabled"`
+                        StorePath             string `yaml:"store_path"`              // Crypto store database; defaults to <token_file>.crypto.db
+                        PickleKey             string `yaml:"pickle_key"`              // Key used to encrypt the crypto store
+                        RecoveryKey           string `yaml:"recovery_key"`            // Verifies this device via cross-signing secrets in SSSS
+                        BootstrapCrossSigning bool   `yaml:"bootstrap_cross_signing"` // Create cross-signing keys if the account has none
+                        Passphrase            string `yaml:"passphrase"`              // Optional SSSS passphrase used when bootstrapping
+                } `yaml:"encryption"`
+                Commands struct {
+                        Enabled       bool     `yaml:"enabled"`         // Respond to !wall commands in configured rooms
+                        AllowedUsers  []string `yaml:"allowed_users"`   // Users who may always run commands
+                        MinPowerLevel int      `yaml:"min_power_level"` // Room power level that grants access; 0 disables the check
+                } `yaml:"commands"`
+                Appservice MatrixAppserviceConfig `yaml:"appservice"`
+                Caption     string `yaml:"caption"`      // Default text/template for room captions
+                CaptionHTML string `yaml:"caption_html"` // Default text/template for formatted_body
         } `yaml:"matrix"`
         Wallhaven struct {
                 APIToken   string `yaml:"api_token"`
@@ -21,9 +40,11 @@ type Config struct {
                 Purity     string `yaml:"purity"`
                 Sorting    string `yaml:"sorting"`
                 Toprange   []string `yaml:"toprange"`
+                Schedule   map[string]string `yaml:"schedule"` // Cron expression per toprange; others are fetched every wait_time seconds
                 Order      string `yaml:"order"`
                 // AIFilter   string `yaml:"ai_filter"` // No longer supported by Wallhaven API
                 UserAgent  string `yaml:"user_agent"`
+                RateLimit  int    `yaml:"rate_limit"` // API requests per minute shared by all workers, default 45
         } `yaml:"wallhaven"`
         Database string `yaml:"database"`
         WaitTime int    `yaml:"wait_time"`
@@ -32,23 +53,172 @@ type Config struct {
             Server      string `yaml:"mastodon_server"`
             AccessToken string `yaml:"mastodon_token"`
             Enabled     bool   `yaml:"enabled"` // Set to false to disable Mastodon posting
-        }
-        Ntfy struct {
-            Server  string `yaml:"server"`
-            Topic   string `yaml:"topic"`
-            Enabled bool   `yaml:"enabled"` // Set to false to disable ntfy notifications
-        } `yaml:"ntfy"`
-        Debug bool `yaml:"debug"`
+            Template    string `yaml:"template"` // text/template for the status; empty uses the default
+        } `yaml:"mastodon"`
+        Ntfy NtfyConfig `yaml:"ntfy"`
+        Gotify struct {
+            Enabled   bool   `yaml:"enabled"`
+            Server    string `yaml:"server"`
+            Token     string `yaml:"token"`      // Application token
+            Priority  int    `yaml:"priority"`
+            FullImage bool   `yaml:"full_image"` // Use the original as bigImageUrl instead of the large thumbnail
+            Template  string `yaml:"template"`   // text/template for the markdown message; empty uses the default
+        } `yaml:"gotify"`
+        Webhook struct {
+            Enabled          bool   `yaml:"enabled"`
+            URL              string `yaml:"url"`
+            Secret           string `yaml:"secret"`             // HMAC-SHA256 key for the signature header
+            VariantsDir      string `yaml:"variants_dir"`       // Keep copies of the image and thumbnail here and serve them under http.public_url
+            VariantsTTLHours int    `yaml:"variants_ttl_hours"` // How long to keep variants, default 24
+            IncludeDetails   bool   `yaml:"include_details"`    // Fill in the uploader and tags; costs an API call per image
+        } `yaml:"webhook"`
+        Outbox struct {
+            Enabled   bool   `yaml:"enabled"`     // Queue prepared images and release them on a schedule instead of posting them at once
+            Dir       string `yaml:"dir"`         // Where queued images are kept until released, default "outbox"
+            Interval  int    `yaml:"interval"`    // Minutes between releases, default 30
+            Start     string `yaml:"start"`       // Posting window as HH:MM, e.g. "08:00"; empty means all day
+            End       string `yaml:"end"`         // End of the window, e.g. "22:00"; may be before Start to span midnight
+            Timezone  string `yaml:"timezone"`    // IANA time zone of the window, default local time
+            MaxPerDay int    `yaml:"max_per_day"` // Releases per calendar day in Timezone; 0 means unlimited
+        } `yaml:"outbox"`
+        Cache struct {
+            Enabled   bool   `yaml:"enabled"`    // Keep Wallhaven API responses on disk, shared between runs
+            Dir       string `yaml:"dir"`        // Default "cache"
+            ImageTTL  int    `yaml:"image_ttl"`  // Minutes an image's details are reused, default 1440; -1 disables
+            SearchTTL int    `yaml:"search_ttl"` // Minutes a search page is reused, default 10; -1 disables
+        } `yaml:"cache"`
+        Health struct {
+            FetchGrace    int `yaml:"fetch_grace"`     // Minutes a toprange's scheduled fetch may be overdue before /healthz fails, default 30
+            MaxPublishAge int `yaml:"max_publish_age"` // Minutes without a successful publish to a destination before /healthz fails; 0 disables
+        } `yaml:"health"`
+        HTTP struct {
+            Listen    string `yaml:"listen"`     // Address for the bot's HTTP server, e.g. ":8080"; disabled if empty
+            PublicURL string `yaml:"public_url"` // How ntfy and other services reach the HTTP server
+        } `yaml:"http"`
+        HTTPClient struct {
+            Timeouts   map[string]int `yaml:"timeouts"`    // Seconds per service: wallhaven, download, openai, mastodon, ntfy, gotify, webhook, matrix
+            Proxy      string         `yaml:"proxy"`       // http://, https:// or socks5:// proxy for outbound requests; default uses HTTPS_PROXY/HTTP_PROXY
+            CAFile     string         `yaml:"ca_file"`     // PEM bundle trusted in addition to the system CAs
+            UserAgent  string         `yaml:"user_agent"`  // Default User-Agent; wallhaven.user_agent still applies to Wallhaven
+            MaxRetries int            `yaml:"max_retries"` // Retries on 429/5xx, default 3; -1 disables
+            RetryWait  int            `yaml:"retry_wait"`  // Seconds before the first retry, doubled each time, default 1
+        } `yaml:"http_client"`
+        Logging struct {
+            Level  string `yaml:"level"`  // debug, info (default), warn or error
+            Format string `yaml:"format"` // text (default) or json
+        } `yaml:"logging"`
+        Debug bool `yaml:"debug"` // Deprecated: same as logging.level: debug
+        WatchConfig bool `yaml:"watch_config"` // Also reload when the config file changes, not only on SIGHUP
         MaxConcurrentImages int `yaml:"max_concurrent_images"` // Number of images to process in parallel
+
+        Templates *Templates `yaml:"-"` // Compiled message templates, set by LoadConfig
+}
+
+// NtfyConfig configures ntfy notifications.
+type NtfyConfig struct {
+        Server  string `yaml:"server"`
+        Topic   string `yaml:"topic"`
+        Enabled bool   `yaml:"enabled"` // Set to false to disable ntfy notifications
+        AccessToken string `yaml:"access_token"` // Sent as a Bearer token; takes precedence over username/password
+        Username    string `yaml:"username"`
+        Password    string `yaml:"password"`
+        Priority    string `yaml:"priority"` // Default priority (min|low|default|high|urgent), "low" if empty
+        Icon        string `yaml:"icon"`     // URL of the notification icon
+        Tags        []string `yaml:"tags"`   // Extra tags/emojis added to every notification
+        Feeds       map[string]NtfyFeedConfig `yaml:"feeds"` // Per-toprange overrides
+        FavouriteSecret string `yaml:"favourite_secret"` // Signs "Set as favourite" callbacks; the button is hidden if empty
+        Mode              string `yaml:"mode"`                // "upload" (default) sends the file, "attach" has ntfy fetch it by URL
+        AttachmentLimitMB int    `yaml:"attachment_limit_mb"` // Server attachment size limit; larger images are downscaled or replaced by a thumbnail
+        Template          string `yaml:"template"`            // text/template for the message; empty uses the default
+        WallhavenTags     bool   `yaml:"wallhaven_tags"`      // Add the wallpaper's tags as ntfy tags; costs an API call per image
+}
+
+// attachmentLimit returns the attachment size limit in bytes, 0 if unlimited.
+func (c NtfyConfig) attachmentLimit() int64 {
+        return int64(c.AttachmentLimitMB) * 1024 * 1024
+}
+
+// NtfyFeedConfig overrides ntfy settings for images from one toprange.
+type NtfyFeedConfig struct {
+        Priority string   `yaml:"priority"`
+        Icon     string   `yaml:"icon"`
+        Tags     []string `yaml:"tags"`
+}
+
+// MatrixRoomConfig describes one Matrix room the bot posts to and what it posts there.
+type MatrixRoomConfig struct {
+        Room    string   `yaml:"room"`    // Room ID (!abc:example.org) or alias (#wallpapers:example.org)
+        Feeds   []string `yaml:"feeds"`   // Toprange values posted to this room; empty means all
+        Purity  []string `yaml:"purity"`  // sfw, sketchy and/or nsfw; empty means all
+        Caption string   `yaml:"caption"` // Go text/template for the caption; empty uses matrix.caption
+        Upload  string   `yaml:"upload"`  // "original" (default) or "thumbnail"
+
+        CaptionHTML       string `yaml:"caption_html"`       // Go text/template for formatted_body; defaults to matrix.caption_html unless Caption is set
+        ThreadDescription bool   `yaml:"thread_description"` // Post the AI description as a thread reply instead of in the caption
+}
+
+// MatrixAppserviceConfig configures appservice mode, where the bot is
+// registered with the homeserver instead of logging in with a password.
+type MatrixAppserviceConfig struct {
+        Enabled          bool   `yaml:"enabled"`
+        Registration     string `yaml:"registration"`      // Registration YAML, created with "generate-registration"
+        ID               string `yaml:"id"`
+        URL              string `yaml:"url"`               // Where the homeserver sends transactions, e.g. http://localhost:29333
+        ListenAddress    string `yaml:"listen_address"`    // host:port to listen on for transactions
+        HomeserverDomain string `yaml:"homeserver_domain"` // Server name used in user IDs
+        BotLocalpart     string `yaml:"bot_localpart"`
+        UserPrefix       string `yaml:"user_prefix"`       // Virtual users are <prefix><feed>, default "wallhaven_"
+        Feeds            map[string]AppserviceFeedUser `yaml:"feeds"`
+}
+
+func (c MatrixAppserviceConfig) userPrefix() string {
+        if c.UserPrefix == "" {
+                return defaultAppserviceUserPrefix
+        }
+        return c.UserPrefix
 }
 
+// AppserviceFeedUser customises the virtual user that posts a feed in appservice mode.
+type AppserviceFeedUser struct {
+        Localpart   string `yaml:"localpart"`   // Defaults to <user_prefix><feed>
+        DisplayName string `yaml:"displayname"`
+        AvatarURL   string `yaml:"avatar_url"`  // mxc:// URI
+}
+
+// MatrixRooms returns the configured rooms, falling back to the single room_id.
+func (cfg *Config) MatrixRooms() []MatrixRoomConfig {
+        if len(cfg.Matrix.Rooms) > 0 {
+                return cfg.Matrix.Rooms
+        }
+        if cfg.Matrix.RoomID == "" {
+                return nil
+        }
+        return []MatrixRoomConfig{{Room: cfg.Matrix.RoomID}}
+}
+
+// LoadConfig reads the config file, expanding ${VAR} references, *_file
+// secrets and WALLHAVEN_DAILY_* environment overrides (see configenv.go), and
+// rejects unknown keys and invalid values.
 func LoadConfig(filename string) (*Config, error) {
         data, err := ioutil.ReadFile(filename)
         if err != nil {
                 return nil, err
         }
+        data, err = preprocessConfig(data)
+        if err != nil {
+                return nil, err
+        }
+        if err := checkUnknownKeys(data); err != nil {
+                return nil, err
+        }
         var cfg Config
-        if err := yaml.Unmarshal(data, &cfg); err != nil {
+        if err := yaml.UnmarshalStrict(data, &cfg); err != nil {
+                return nil, err
+        }
+        if err := cfg.Validate(); err != nil {
+                return nil, err
+        }
+        if err := cfg.compileTemplates(); err != nil {
                 return nil, err
         }
         return &cfg, nil
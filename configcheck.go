@@ -0,0 +1,317 @@
+package main
+
+import (
+    "fmt"
+    "log/slog"
+    "net"
+    "net/url"
+    "os"
+    "reflect"
+    "regexp"
+    "sort"
+    "strings"
+
+    "gopkg.in/yaml.v2"
+)
+
+var (
+    wallhavenSortings  = []string{"date_added", "relevance", "random", "views", "favorites", "toplist", "hot"}
+    wallhavenTopranges = []string{"1d", "3d", "1w", "1M", "3M", "6M", "1y"}
+    wallhavenPurities  = []string{"sfw", "sketchy", "nsfw"}
+    ntfyPriorities     = []string{"", "min", "low", "default", "high", "urgent", "max", "1", "2", "3", "4", "5"}
+    bitmaskPattern     = regexp.MustCompile(`^[01]{3}$`)
+)
+
+// ConfigError lists every problem found in a config file.
+type ConfigError struct {
+    Problems []string
+}
+
+func (e *ConfigError) Error() string {
+    if len(e.Problems) == 1 {
+        return "invalid config: " + e.Problems[0]
+    }
+    return fmt.Sprintf("invalid config, %d problems:\n  - %s", len(e.Problems), strings.Join(e.Problems, "\n  - "))
+}
+
+// configChecker collects problems so they can be reported all at once.
+type configChecker struct {
+    problems []string
+}
+
+func (c *configChecker) addf(format string, args ...interface{}) {
+    c.problems = append(c.problems, fmt.Sprintf(format, args...))
+}
+
+func (c *configChecker) err() error {
+    if len(c.problems) == 0 {
+        return nil
+    }
+    return &ConfigError{Problems: c.problems}
+}
+
+// checkURL requires an absolute http(s) URL.
+func (c *configChecker) checkURL(key, value string) {
+    if value == "" {
+        c.addf("%s is required", key)
+        return
+    }
+    u, err := url.Parse(value)
+    if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+        c.addf("%s: %q is not an http(s) URL", key, value)
+    }
+}
+
+func (c *configChecker) checkRequired(key, value string) {
+    if value == "" {
+        c.addf("%s is required", key)
+    }
+}
+
+func (c *configChecker) checkNotNegative(key string, value int) {
+    if value < 0 {
+        c.addf("%s must not be negative, got %d", key, value)
+    }
+}
+
+func (c *configChecker) checkOneOf(key, value string, allowed []string) {
+    if !containsString(allowed, value) {
+        c.addf("%s: %q is not one of %s", key, value, strings.Join(allowed, ", "))
+    }
+}
+
+func (c *configChecker) checkHostPort(key, value string) {
+    if _, _, err := net.SplitHostPort(value); err != nil {
+        c.addf("%s: %q is not host:port: %v", key, value, err)
+    }
+}
+
+// checkUnknownKeys reports config keys that don't match any field, with
+// their full path so typos are easy to find.
+func checkUnknownKeys(data []byte) error {
+    var root yaml.MapSlice
+    if err := yaml.Unmarshal(data, &root); err != nil {
+        return err
+    }
+    c := &configChecker{}
+    c.unknownKeys(root, reflect.TypeOf(Config{}), "")
+    return c.err()
+}
+
+func (c *configChecker) unknownKeys(node interface{}, t reflect.Type, path string) {
+    for t.Kind() == reflect.Ptr {
+        t = t.Elem()
+    }
+    switch t.Kind() {
+    case reflect.Struct:
+        m, ok := node.(yaml.MapSlice)
+        if !ok {
+            return
+        }
+        fields := map[string]reflect.Type{}
+        for i := 0; i < t.NumField(); i++ {
+            if key := yamlKey(t.Field(i)); key != "" {
+                fields[key] = t.Field(i).Type
+            }
+        }
+        for _, item := range m {
+            key := fmt.Sprint(item.Key)
+            name := key
+            if path != "" {
+                name = path + "." + key
+            }
+            fieldType, ok := fields[key]
+            if !ok {
+                var known []string
+                for k := range fields {
+                    known = append(known, k)
+                }
+                sort.Strings(known)
+                c.addf("%s: unknown key (known keys: %s)", name, strings.Join(known, ", "))
+                continue
+            }
+            c.unknownKeys(item.Value, fieldType, name)
+        }
+    case reflect.Slice:
+        if list, ok := node.([]interface{}); ok {
+            for i, item := range list {
+                c.unknownKeys(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i))
+            }
+        }
+    case reflect.Map:
+        if m, ok := node.(yaml.MapSlice); ok {
+            for _, item := range m {
+                c.unknownKeys(item.Value, t.Elem(), fmt.Sprintf("%s.%v", path, item.Key))
+            }
+        }
+    }
+}
+
+// Validate checks the values of every setting and returns a *ConfigError
+// listing all problems, or nil.
+func (cfg *Config) Validate() error {
+    c := &configChecker{}
+
+    w := cfg.Wallhaven
+    if w.Categories != "" && (!bitmaskPattern.MatchString(w.Categories) || w.Categories == "000") {
+        c.addf("wallhaven.categories: %q must be three 0/1 flags (general, anime, people) with at least one set", w.Categories)
+    }
+    if w.Purity != "" && (!bitmaskPattern.MatchString(w.Purity) || w.Purity == "000") {
+        c.addf("wallhaven.purity: %q must be three 0/1 flags (sfw, sketchy, nsfw) with at least one set", w.Purity)
+    }
+    if w.Sorting != "" {
+        c.checkOneOf("wallhaven.sorting", w.Sorting, wallhavenSortings)
+    }
+    if w.Order != "" {
+        c.checkOneOf("wallhaven.order", w.Order, []string{"desc", "asc"})
+    }
+    if len(w.Toprange) == 0 {
+        c.addf("wallhaven.toprange must list at least one range")
+    }
+    for _, feed := range w.Toprange {
+        c.checkOneOf("wallhaven.toprange", feed, wallhavenTopranges)
+    }
+    if _, err := cfg.FeedSchedules(); err != nil {
+        c.addf("%v", err)
+    }
+    c.checkNotNegative("wallhaven.rate_limit", w.RateLimit)
+    c.checkNotNegative("wait_time", cfg.WaitTime)
+    c.checkNotNegative("max_concurrent_images", cfg.MaxConcurrentImages)
+    c.checkRequired("database", cfg.Database)
+
+    if cfg.Matrix.Enabled {
+        cfg.validateMatrix(c)
+    }
+    if cfg.Mastodon.Enabled {
+        c.checkURL("mastodon.mastodon_server", cfg.Mastodon.Server)
+        c.checkRequired("mastodon.mastodon_token", cfg.Mastodon.AccessToken)
+    }
+    if cfg.Ntfy.Enabled {
+        n := cfg.Ntfy
+        c.checkURL("ntfy.server", n.Server)
+        c.checkRequired("ntfy.topic", n.Topic)
+        c.checkOneOf("ntfy.priority", n.Priority, ntfyPriorities)
+        c.checkOneOf("ntfy.mode", n.Mode, []string{"", "upload", "attach"})
+        c.checkNotNegative("ntfy.attachment_limit_mb", n.AttachmentLimitMB)
+        if n.Icon != "" {
+            c.checkURL("ntfy.icon", n.Icon)
+        }
+        for feed, override := range n.Feeds {
+            if !containsString(w.Toprange, feed) {
+                c.addf("ntfy.feeds.%s: not in wallhaven.toprange", feed)
+            }
+            c.checkOneOf("ntfy.feeds."+feed+".priority", override.Priority, ntfyPriorities)
+        }
+    }
+    if cfg.Gotify.Enabled {
+        c.checkURL("gotify.server", cfg.Gotify.Server)
+        c.checkRequired("gotify.token", cfg.Gotify.Token)
+    }
+    if cfg.Webhook.Enabled {
+        c.checkURL("webhook.url", cfg.Webhook.URL)
+        c.checkNotNegative("webhook.variants_ttl_hours", cfg.Webhook.VariantsTTLHours)
+        if cfg.Webhook.VariantsDir != "" && cfg.HTTP.PublicURL == "" {
+            c.addf("webhook.variants_dir needs http.public_url")
+        }
+    }
+
+    c.checkNotNegative("outbox.interval", cfg.Outbox.Interval)
+    c.checkNotNegative("outbox.max_per_day", cfg.Outbox.MaxPerDay)
+    if _, err := cfg.OutboxSchedule(); err != nil {
+        c.addf("%v", err)
+    }
+    if cfg.Cache.ImageTTL < -1 {
+        c.addf("cache.image_ttl must be -1 (not cached) or more, got %d", cfg.Cache.ImageTTL)
+    }
+    if cfg.Cache.SearchTTL < -1 {
+        c.addf("cache.search_ttl must be -1 (not cached) or more, got %d", cfg.Cache.SearchTTL)
+    }
+    c.checkNotNegative("health.fetch_grace", cfg.Health.FetchGrace)
+    c.checkNotNegative("health.max_publish_age", cfg.Health.MaxPublishAge)
+
+    if cfg.HTTP.Listen != "" {
+        c.checkHostPort("http.listen", cfg.HTTP.Listen)
+    }
+    if cfg.HTTP.PublicURL != "" {
+        c.checkURL("http.public_url", cfg.HTTP.PublicURL)
+    }
+    for service, seconds := range cfg.HTTPClient.Timeouts {
+        if _, ok := serviceTimeouts[service]; !ok {
+            c.addf("http_client.timeouts: unknown service %q", service)
+        } else if seconds <= 0 {
+            c.addf("http_client.timeouts.%s must be positive, got %d", service, seconds)
+        }
+    }
+    if _, err := newHTTPTransport(cfg); err != nil {
+        c.addf("http_client: %v", err)
+    }
+    if cfg.HTTPClient.MaxRetries < -1 {
+        c.addf("http_client.max_retries must be -1 (no retries) or more, got %d", cfg.HTTPClient.MaxRetries)
+    }
+    c.checkNotNegative("http_client.retry_wait", cfg.HTTPClient.RetryWait)
+    if cfg.Logging.Level != "" {
+        var level slog.Level
+        if err := level.UnmarshalText([]byte(cfg.Logging.Level)); err != nil {
+            c.addf("logging.level: %q is not debug, info, warn or error", cfg.Logging.Level)
+        }
+    }
+    c.checkOneOf("logging.format", strings.ToLower(cfg.Logging.Format), []string{"", "text", "json"})
+    return c.err()
+}
+
+func (cfg *Config) validateMatrix(c *configChecker) {
+    m := cfg.Matrix
+    c.checkURL("matrix.server_url", m.ServerURL)
+    if m.Appservice.Enabled {
+        as := m.Appservice
+        c.checkRequired("matrix.appservice.registration", as.Registration)
+        c.checkURL("matrix.appservice.url", as.URL)
+        c.checkHostPort("matrix.appservice.listen_address", as.ListenAddress)
+        c.checkRequired("matrix.appservice.homeserver_domain", as.HomeserverDomain)
+        if m.Encryption.Enabled {
+            c.addf("matrix.encryption is not supported in appservice mode")
+        }
+        for feed := range as.Feeds {
+            if !containsString(cfg.Wallhaven.Toprange, feed) {
+                c.addf("matrix.appservice.feeds.%s: not in wallhaven.toprange", feed)
+            }
+        }
+    } else if !strings.HasPrefix(m.User, "@") || !strings.Contains(m.User, ":") {
+        c.addf("matrix.user: %q is not a Matrix user ID like @bot:example.org", m.User)
+    }
+    if m.Encryption.Enabled && m.Encryption.PickleKey == "" {
+        c.addf("matrix.encryption.pickle_key is required when encryption is enabled")
+    }
+
+    rooms := cfg.MatrixRooms()
+    if len(rooms) == 0 {
+        c.addf("matrix: set room_id or list rooms")
+    }
+    for i, room := range rooms {
+        key := fmt.Sprintf("matrix.rooms[%d]", i)
+        if !strings.HasPrefix(room.Room, "!") && !strings.HasPrefix(room.Room, "#") || !strings.Contains(room.Room, ":") {
+            c.addf("%s.room: %q is not a room ID (!id:server) or alias (#alias:server)", key, room.Room)
+        }
+        for _, feed := range room.Feeds {
+            if !containsString(cfg.Wallhaven.Toprange, feed) {
+                c.addf("%s.feeds: %q is not in wallhaven.toprange", key, feed)
+            }
+        }
+        for _, purity := range room.Purity {
+            c.checkOneOf(key+".purity", purity, wallhavenPurities)
+        }
+        c.checkOneOf(key+".upload", room.Upload, []string{"", "original", "thumbnail"})
+    }
+}
+
+// runConfigCheck implements "config check [file]": it loads and validates
+// the config and prints every problem, exiting non-zero if there are any.
+func runConfigCheck(filename string) int {
+    if _, err := LoadConfig(filename); err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        return 1
+    }
+    fmt.Printf("%s is valid\n", filename)
+    return 0
+}
+
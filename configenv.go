@@ -0,0 +1,218 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "reflect"
+    "regexp"
+    "strings"
+
+    "gopkg.in/yaml.v2"
+)
+
+// envPrefix starts the environment variables that override config keys,
+// e.g. WALLHAVEN_DAILY_WALLHAVEN_API_TOKEN for wallhaven.api_token.
+const envPrefix = "WALLHAVEN_DAILY_"
+
+// secretKeys are the config keys that may also be read from a file named by
+// <key>_file, e.g. openai_key_file or matrix.password_file.
+var secretKeys = map[string]bool{
+    "matrix.password":                true,
+    "matrix.login_token":             true,
+    "matrix.encryption.pickle_key":   true,
+    "matrix.encryption.recovery_key": true,
+    "matrix.encryption.passphrase":   true,
+    "wallhaven.api_token":            true,
+    "openai_key":                     true,
+    "mastodon.mastodon_token":        true,
+    "ntfy.access_token":              true,
+    "ntfy.password":                  true,
+    "ntfy.favourite_secret":          true,
+    "gotify.token":                   true,
+    "webhook.secret":                 true,
+}
+
+// envRefPattern matches ${VAR} and ${VAR:-default}; $${ is a literal ${.
+var envRefPattern = regexp.MustCompile(`\$?\$\{([A-Za-z_][A-Za-z0-9_]*)(:-[^}]*)?\}`)
+
+// preprocessConfig expands ${VAR} references in the config values, reads
+// secrets from their *_file variants and applies WALLHAVEN_DAILY_*
+// environment overrides, returning YAML ready to decode into a Config.
+func preprocessConfig(data []byte) ([]byte, error) {
+    var root yaml.MapSlice
+    if err := yaml.Unmarshal(data, &root); err != nil {
+        return nil, err
+    }
+    expanded, err := expandEnvValues(root, "")
+    if err != nil {
+        return nil, err
+    }
+    root, _ = expanded.(yaml.MapSlice)
+    root, err = applyConfigOverrides(root, reflect.TypeOf(Config{}), nil)
+    if err != nil {
+        return nil, err
+    }
+    return yaml.Marshal(root)
+}
+
+// expandEnvValues expands ${VAR} in every string value below node. Keys and
+// comments are left alone.
+func expandEnvValues(node interface{}, path string) (interface{}, error) {
+    switch v := node.(type) {
+    case yaml.MapSlice:
+        for i := range v {
+            key := fmt.Sprint(v[i].Key)
+            if path != "" {
+                key = path + "." + key
+            }
+            value, err := expandEnvValues(v[i].Value, key)
+            if err != nil {
+                return nil, err
+            }
+            v[i].Value = value
+        }
+        return v, nil
+    case []interface{}:
+        for i := range v {
+            value, err := expandEnvValues(v[i], fmt.Sprintf("%s[%d]", path, i))
+            if err != nil {
+                return nil, err
+            }
+            v[i] = value
+        }
+        return v, nil
+    case string:
+        expanded, err := expandEnv(v)
+        if err != nil {
+            return nil, fmt.Errorf("%s: %w", path, err)
+        }
+        return expanded, nil
+    }
+    return node, nil
+}
+
+// expandEnv replaces ${VAR} with the variable's value. An unset variable
+// without a default is an error, so a missing secret isn't silently empty.
+func expandEnv(s string) (string, error) {
+    var missing []string
+    out := envRefPattern.ReplaceAllStringFunc(s, func(ref string) string {
+        if strings.HasPrefix(ref, "$$") {
+            return ref[1:]
+        }
+        m := envRefPattern.FindStringSubmatch(ref)
+        if value, ok := os.LookupEnv(m[1]); ok {
+            return value
+        }
+        if m[2] != "" {
+            return strings.TrimPrefix(m[2], ":-")
+        }
+        missing = append(missing, m[1])
+        return ""
+    })
+    if len(missing) > 0 {
+        return "", fmt.Errorf("environment variable %s is not set", strings.Join(missing, ", "))
+    }
+    return out, nil
+}
+
+// applyConfigOverrides walks the fields of t alongside the YAML mapping node.
+// Secrets named by a *_file key (or WALLHAVEN_DAILY_..._FILE) are read from
+// that file, then WALLHAVEN_DAILY_* variables replace any value. Lists and
+// maps are given in YAML flow syntax, e.g. WALLHAVEN_DAILY_WALLHAVEN_TOPRANGE="[1d, 1w]".
+func applyConfigOverrides(node yaml.MapSlice, t reflect.Type, path []string) (yaml.MapSlice, error) {
+    for i := 0; i < t.NumField(); i++ {
+        field := t.Field(i)
+        key := yamlKey(field)
+        if key == "" {
+            continue
+        }
+        keyPath := append(append([]string{}, path...), key)
+        name := strings.Join(keyPath, ".")
+        env := envPrefix + strings.ToUpper(strings.Join(keyPath, "_"))
+
+        if field.Type.Kind() == reflect.Struct {
+            child, _ := mapValue(node, key).(yaml.MapSlice)
+            child, err := applyConfigOverrides(child, field.Type, keyPath)
+            if err != nil {
+                return nil, err
+            }
+            if len(child) > 0 {
+                node = setMapValue(node, key, child)
+            }
+            continue
+        }
+
+        if secretKeys[name] {
+            file, _ := mapValue(node, key+"_file").(string)
+            if value, ok := os.LookupEnv(env + "_FILE"); ok {
+                file = value
+            }
+            node = deleteMapValue(node, key+"_file")
+            if file != "" {
+                data, err := os.ReadFile(file)
+                if err != nil {
+                    return nil, fmt.Errorf("%s_file: %w", name, err)
+                }
+                node = setMapValue(node, key, strings.TrimRight(string(data), "\r\n"))
+            }
+        }
+
+        value, ok := os.LookupEnv(env)
+        if !ok {
+            continue
+        }
+        if field.Type.Kind() == reflect.String {
+            node = setMapValue(node, key, value)
+            continue
+        }
+        var parsed interface{}
+        if err := yaml.Unmarshal([]byte(value), &parsed); err != nil {
+            return nil, fmt.Errorf("%s: %w", env, err)
+        }
+        node = setMapValue(node, key, parsed)
+    }
+    return node, nil
+}
+
+// yamlKey returns the key yaml.v2 uses for a field, or "" if it is skipped.
+func yamlKey(field reflect.StructField) string {
+    if field.PkgPath != "" {
+        return ""
+    }
+    tag := strings.Split(field.Tag.Get("yaml"), ",")[0]
+    switch tag {
+    case "-":
+        return ""
+    case "":
+        return strings.ToLower(field.Name)
+    }
+    return tag
+}
+
+func mapValue(node yaml.MapSlice, key string) interface{} {
+    for _, item := range node {
+        if fmt.Sprint(item.Key) == key {
+            return item.Value
+        }
+    }
+    return nil
+}
+
+func setMapValue(node yaml.MapSlice, key string, value interface{}) yaml.MapSlice {
+    for i, item := range node {
+        if fmt.Sprint(item.Key) == key {
+            node[i].Value = value
+            return node
+        }
+    }
+    return append(node, yaml.MapItem{Key: key, Value: value})
+}
+
+func deleteMapValue(node yaml.MapSlice, key string) yaml.MapSlice {
+    for i, item := range node {
+        if fmt.Sprint(item.Key) == key {
+            return append(node[:i], node[i+1:]...)
+        }
+    }
+    return node
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+    "os"
+    "path/filepath"
+    "reflect"
+    "testing"
+
+    "gopkg.in/yaml.v2"
+)
+
+func TestExpandEnv(t *testing.T) {
+    t.Setenv("WD_TEST_SET", "value")
+    t.Setenv("WD_TEST_EMPTY", "")
+    tests := []struct {
+        in      string
+        want    string
+        wantErr bool
+    }{
+        {"${WD_TEST_SET}", "value", false},
+        {"a-${WD_TEST_SET}-b", "a-value-b", false},
+        {"${WD_TEST_EMPTY}", "", false},
+        {"${WD_TEST_UNSET:-fallback}", "fallback", false},
+        {"${WD_TEST_SET:-fallback}", "value", false},
+        {"$${WD_TEST_SET}", "${WD_TEST_SET}", false},
+        {"$WD_TEST_SET and $5", "$WD_TEST_SET and $5", false},
+        {"${WD_TEST_UNSET}", "", true},
+    }
+    for _, tt := range tests {
+        got, err := expandEnv(tt.in)
+        if (err != nil) != tt.wantErr {
+            t.Errorf("expandEnv(%q) error = %v, want error %v", tt.in, err, tt.wantErr)
+            continue
+        }
+        if got != tt.want {
+            t.Errorf("expandEnv(%q) = %q, want %q", tt.in, got, tt.want)
+        }
+    }
+}
+
+func TestPreprocessConfig(t *testing.T) {
+    dir := t.TempDir()
+    secretFile := filepath.Join(dir, "secret")
+    if err := os.WriteFile(secretFile, []byte("from-file\n"), 0600); err != nil {
+        t.Fatal(err)
+    }
+
+    tests := []struct {
+        name    string
+        config  string
+        env     map[string]string
+        check   func(cfg *Config) interface{}
+        want    interface{}
+        wantErr bool
+    }{
+        {
+            name:   "variable in a value",
+            config: "wallhaven:\n  api_token: ${WD_TEST_TOKEN}\n",
+            env:    map[string]string{"WD_TEST_TOKEN": "abc"},
+            check:  func(cfg *Config) interface{} { return cfg.Wallhaven.APIToken },
+            want:   "abc",
+        },
+        {
+            name:    "unset variable",
+            config:  "wallhaven:\n  api_token: ${WD_TEST_MISSING}\n",
+            wantErr: true,
+        },
+        {
+            name:   "secret file",
+            config: "openai_key_file: " + secretFile + "\n",
+            check:  func(cfg *Config) interface{} { return cfg.OpenAIKey },
+            want:   "from-file",
+        },
+        {
+            name:   "nested secret file",
+            config: "matrix:\n  password: inline\n  password_file: " + secretFile + "\n",
+            check:  func(cfg *Config) interface{} { return cfg.Matrix.Password },
+            want:   "from-file",
+        },
+        {
+            name:    "missing secret file",
+            config:  "openai_key_file: " + filepath.Join(dir, "missing") + "\n",
+            wantErr: true,
+        },
+        {
+            name:   "secret file from the environment",
+            config: "matrix:\n  user: \"@bot:example.org\"\n",
+            env:    map[string]string{"WALLHAVEN_DAILY_MATRIX_PASSWORD_FILE": secretFile},
+            check:  func(cfg *Config) interface{} { return cfg.Matrix.Password },
+            want:   "from-file",
+        },
+        {
+            name:   "environment overrides a string",
+            config: "wallhaven:\n  api_token: from-config\n",
+            env:    map[string]string{"WALLHAVEN_DAILY_WALLHAVEN_API_TOKEN": "from-env"},
+            check:  func(cfg *Config) interface{} { return cfg.Wallhaven.APIToken },
+            want:   "from-env",
+        },
+        {
+            name:   "environment overrides a list",
+            config: "wallhaven:\n  toprange: [1d]\n",
+            env:    map[string]string{"WALLHAVEN_DAILY_WALLHAVEN_TOPRANGE": "[1d, 1w]"},
+            check:  func(cfg *Config) interface{} { return cfg.Wallhaven.Toprange },
+            want:   []string{"1d", "1w"},
+        },
+        {
+            name:   "environment overrides a number",
+            config: "wait_time: 60\n",
+            env:    map[string]string{"WALLHAVEN_DAILY_WAIT_TIME": "120"},
+            check:  func(cfg *Config) interface{} { return cfg.WaitTime },
+            want:   120,
+        },
+        {
+            name:   "environment sets a missing section",
+            config: "database: wallhaven.db\n",
+            env:    map[string]string{"WALLHAVEN_DAILY_OUTBOX_ENABLED": "true"},
+            check:  func(cfg *Config) interface{} { return cfg.Outbox.Enabled },
+            want:   true,
+        },
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            for key, value := range tt.env {
+                t.Setenv(key, value)
+            }
+            data, err := preprocessConfig([]byte(tt.config))
+            if (err != nil) != tt.wantErr {
+                t.Fatalf("preprocessConfig error = %v, want error %v", err, tt.wantErr)
+            }
+            if tt.wantErr {
+                return
+            }
+            var cfg Config
+            if err := yaml.UnmarshalStrict(data, &cfg); err != nil {
+                t.Fatalf("decoding the result: %v\n%s", err, data)
+            }
+            if got := tt.check(&cfg); !reflect.DeepEqual(got, tt.want) {
+                t.Errorf("got %#v, want %#v", got, tt.want)
+            }
+        })
+    }
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+    "fmt"
+    "log/slog"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Schedule tells when a feed should be fetched next.
+type Schedule interface {
+    Next(after time.Time) time.Time
+}
+
+// everySchedule runs at a fixed interval after the previous run.
+type everySchedule struct {
+    interval time.Duration
+}
+
+func (s everySchedule) Next(after time.Time) time.Time {
+    return after.Add(s.interval)
+}
+
+// cronSchedule is a standard five-field cron expression:
+// minute hour day-of-month month day-of-week.
+type cronSchedule struct {
+    minute, hour, dom, month, dow uint64 // Bit n is set if value n matches
+    domStar, dowStar              bool
+}
+
+var cronDescriptors = map[string]string{
+    "@hourly":   "0 * * * *",
+    "@daily":    "0 0 * * *",
+    "@midnight": "0 0 * * *",
+    "@weekly":   "0 0 * * 0",
+    "@monthly":  "0 0 1 * *",
+    "@yearly":   "0 0 1 1 *",
+    "@annually": "0 0 1 1 *",
+}
+
+// ParseSchedule parses a cron expression, one of the @hourly style
+// descriptors or "@every <duration>".
+func ParseSchedule(expr string) (Schedule, error) {
+    expr = strings.TrimSpace(expr)
+    if rest := strings.TrimPrefix(expr, "@every "); rest != expr {
+        d, err := time.ParseDuration(strings.TrimSpace(rest))
+        if err != nil {
+            return nil, fmt.Errorf("invalid @every interval: %w", err)
+        }
+        if d < time.Minute {
+            return nil, fmt.Errorf("@every interval %s is shorter than a minute", d)
+        }
+        return everySchedule{interval: d}, nil
+    }
+    if descriptor, ok := cronDescriptors[expr]; ok {
+        expr = descriptor
+    }
+
+    fields := strings.Fields(expr)
+    if len(fields) != 5 {
+        return nil, fmt.Errorf("%q: expected 5 fields (minute hour day month weekday), got %d", expr, len(fields))
+    }
+    var s cronSchedule
+    var err error
+    if s.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+        return nil, fmt.Errorf("minute: %w", err)
+    }
+    if s.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+        return nil, fmt.Errorf("hour: %w", err)
+    }
+    if s.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+        return nil, fmt.Errorf("day of month: %w", err)
+    }
+    if s.month, err = parseCronField(fields[3], 1, 12); err != nil {
+        return nil, fmt.Errorf("month: %w", err)
+    }
+    if s.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+        return nil, fmt.Errorf("day of week: %w", err)
+    }
+    // Sunday can be written as 0 or 7
+    if s.dow&(1<<7) != 0 {
+        s.dow |= 1
+    }
+    s.domStar = fields[2] == "*" || fields[2] == "?"
+    s.dowStar = fields[4] == "*" || fields[4] == "?"
+    return s, nil
+}
+
+// parseCronField parses a comma separated list of values, ranges (a-b) and
+// steps (*/n, a-b/n) into a bit set.
+func parseCronField(field string, min, max int) (uint64, error) {
+    var bits uint64
+    for _, part := range strings.Split(field, ",") {
+        rangePart, step := part, 1
+        if i := strings.Index(part, "/"); i >= 0 {
+            n, err := strconv.Atoi(part[i+1:])
+            if err != nil || n <= 0 {
+                return 0, fmt.Errorf("invalid step in %q", part)
+            }
+            rangePart, step = part[:i], n
+        }
+
+        lo, hi := min, max
+        switch {
+        case rangePart == "*" || rangePart == "?":
+        case strings.Contains(rangePart, "-"):
+            bounds := strings.SplitN(rangePart, "-", 2)
+            var err1, err2 error
+            lo, err1 = strconv.Atoi(bounds[0])
+            hi, err2 = strconv.Atoi(bounds[1])
+            if err1 != nil || err2 != nil {
+                return 0, fmt.Errorf("invalid range %q", rangePart)
+            }
+        default:
+            n, err := strconv.Atoi(rangePart)
+            if err != nil {
+                return 0, fmt.Errorf("invalid value %q", rangePart)
+            }
+            lo, hi = n, n
+            if step > 1 {
+                hi = max
+            }
+        }
+        if lo < min || hi > max || lo > hi {
+            return 0, fmt.Errorf("%q is outside %d-%d", part, min, max)
+        }
+        for v := lo; v <= hi; v += step {
+            bits |= 1 << uint(v)
+        }
+    }
+    return bits, nil
+}
+
+func (s cronSchedule) dayMatches(t time.Time) bool {
+    dom := s.dom&(1<<uint(t.Day())) != 0
+    dow := s.dow&(1<<uint(t.Weekday())) != 0
+    // As in cron, a day matches either field if both are restricted
+    if !s.domStar && !s.dowStar {
+        return dom || dow
+    }
+    return dom && dow
+}
+
+// Next returns the first matching minute after the given time, or the zero
+// time if there is none within five years (e.g. "0 0 31 2 *").
+func (s cronSchedule) Next(after time.Time) time.Time {
+    loc := after.Location()
+    t := after.Truncate(time.Minute).Add(time.Minute)
+    limit := t.AddDate(5, 0, 0)
+    for t.Before(limit) {
+        if s.month&(1<<uint(t.Month())) == 0 {
+            t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+            continue
+        }
+        if !s.dayMatches(t) {
+            t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+            continue
+        }
+        if s.hour&(1<<uint(t.Hour())) == 0 {
+            t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+            continue
+        }
+        if s.minute&(1<<uint(t.Minute())) == 0 {
+            t = t.Add(time.Minute)
+            continue
+        }
+        return t
+    }
+    return time.Time{}
+}
+
+// feedSchedule is the fetch schedule of one toprange.
+type feedSchedule struct {
+    feed     string
+    schedule Schedule
+}
+
+// FeedSchedules returns the schedule of every toprange: its cron expression
+// from wallhaven.schedule, or every wait_time seconds if it has none.
+func (cfg *Config) FeedSchedules() ([]feedSchedule, error) {
+    for feed := range cfg.Wallhaven.Schedule {
+        if !containsString(cfg.Wallhaven.Toprange, feed) {
+            return nil, fmt.Errorf("wallhaven.schedule has an entry for %q, which is not in toprange", feed)
+        }
+    }
+    waitTime := time.Duration(cfg.WaitTime) * time.Second
+    if waitTime <= 0 {
+        waitTime = 10 * time.Minute
+    }
+    var schedules []feedSchedule
+    for _, feed := range cfg.Wallhaven.Toprange {
+        expr, ok := cfg.Wallhaven.Schedule[feed]
+        if !ok {
+            schedules = append(schedules, feedSchedule{feed: feed, schedule: everySchedule{interval: waitTime}})
+            continue
+        }
+        schedule, err := ParseSchedule(expr)
+        if err != nil {
+            return nil, fmt.Errorf("schedule of %s: %w", feed, err)
+        }
+        if schedule.Next(time.Now()).IsZero() {
+            return nil, fmt.Errorf("schedule of %s (%q) never runs", feed, expr)
+        }
+        schedules = append(schedules, feedSchedule{feed: feed, schedule: schedule})
+    }
+    return schedules, nil
+}
+
+// nextRun returns when the feed is due, based on its last run stored in the
+// database. Feeds that have never run are due now, and a feed whose runs were
+// missed while the bot was down runs once, not once per missed run.
+func (fs feedSchedule) nextRun(db *Database, now time.Time) time.Time {
+    last, err := db.LastRun(fs.feed)
+    if err != nil {
+        slog.Error("Failed to read last run, retrying in a minute", "toprange", fs.feed, "error", err)
+        return now.Add(time.Minute)
+    }
+    if last.IsZero() {
+        return now
+    }
+    return fs.schedule.Next(last.In(now.Location()))
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+    "testing"
+    "time"
+)
+
+func TestParseSchedule(t *testing.T) {
+    tests := []struct {
+        expr    string
+        wantErr bool
+    }{
+        {"*/15 * * * *", false},
+        {"0 9 * * 1-5", false},
+        {"0 0 * * 7", false},
+        {"0,30 8-18/2 1 1,7 *", false},
+        {"@daily", false},
+        {"@every 2h", false},
+        {"* * * *", true},
+        {"60 * * * *", true},
+        {"0 24 * * *", true},
+        {"0 0 0 * *", true},
+        {"*/0 * * * *", true},
+        {"5-1 * * * *", true},
+        {"a * * * *", true},
+        {"@every 30s", true},
+        {"@every soon", true},
+        {"@sometimes", true},
+    }
+    for _, tt := range tests {
+        _, err := ParseSchedule(tt.expr)
+        if (err != nil) != tt.wantErr {
+            t.Errorf("ParseSchedule(%q) error = %v, want error %v", tt.expr, err, tt.wantErr)
+        }
+    }
+}
+
+func TestScheduleNext(t *testing.T) {
+    at := func(value string) time.Time {
+        t.Helper()
+        parsed, err := time.Parse("2006-01-02 15:04", value)
+        if err != nil {
+            t.Fatal(err)
+        }
+        return parsed
+    }
+    tests := []struct {
+        name  string
+        expr  string
+        after string
+        want  string // Empty if the schedule never runs
+    }{
+        {"step", "*/15 * * * *", "2024-03-01 10:07", "2024-03-01 10:15"},
+        {"on a match is the next one", "*/15 * * * *", "2024-03-01 10:15", "2024-03-01 10:30"},
+        {"weekdays skip the weekend", "0 9 * * 1-5", "2024-03-01 10:00", "2024-03-04 09:00"},
+        {"sunday as 7", "0 0 * * 7", "2024-03-01 10:00", "2024-03-03 00:00"},
+        {"monthly rolls over the year", "@monthly", "2024-12-15 12:00", "2025-01-01 00:00"},
+        {"hourly", "@hourly", "2024-03-01 10:59", "2024-03-01 11:00"},
+        {"leap day", "0 0 29 2 *", "2024-03-01 00:00", "2028-02-29 00:00"},
+        {"day of month or weekday", "0 0 13 * 5", "2024-09-01 00:00", "2024-09-06 00:00"},
+        {"never", "0 0 31 2 *", "2024-03-01 00:00", ""},
+        {"every", "@every 90m", "2024-03-01 10:07", "2024-03-01 11:37"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            schedule, err := ParseSchedule(tt.expr)
+            if err != nil {
+                t.Fatalf("ParseSchedule(%q): %v", tt.expr, err)
+            }
+            got := schedule.Next(at(tt.after))
+            if tt.want == "" {
+                if !got.IsZero() {
+                    t.Errorf("Next(%s) = %s, want never", tt.after, got)
+                }
+                return
+            }
+            if want := at(tt.want); !got.Equal(want) {
+                t.Errorf("Next(%s) = %s, want %s", tt.after, got, want)
+            }
+        })
+    }
+}
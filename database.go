@@ -1,7 +1,11 @@
 package main
 
 import (
+        "context"
         "database/sql"
+        "encoding/json"
+        "strings"
+        "time"
 
         _ "github.com/mattn/go-sqlite3"
 )
@@ -26,9 +30,48 @@ func (d *Database) init() error {
         query := `
         CREATE TABLE IF NOT EXISTS sent_images (
                 id TEXT PRIMARY KEY
+        );
+        CREATE TABLE IF NOT EXISTS blocked_tags (
+                tag TEXT PRIMARY KEY
+        );
+        CREATE TABLE IF NOT EXISTS favourites (
+                id TEXT PRIMARY KEY
+        );
+        CREATE TABLE IF NOT EXISTS settings (
+                key TEXT PRIMARY KEY,
+                value TEXT NOT NULL
+        );
+        CREATE TABLE IF NOT EXISTS outbox (
+                id TEXT PRIMARY KEY,
+                feed TEXT NOT NULL,
+                image TEXT NOT NULL,
+                image_path TEXT NOT NULL,
+                thumb_path TEXT NOT NULL,
+                description TEXT NOT NULL,
+                queued_at INTEGER NOT NULL,
+                released_at INTEGER,
+                attempts INTEGER NOT NULL DEFAULT 0,
+                next_attempt INTEGER NOT NULL DEFAULT 0
         );`
-        _, err := d.db.Exec(query)
-        return err
+        if _, err := d.db.Exec(query); err != nil {
+                return err
+        }
+        // Outbox tables created before failed releases were retried lack these
+        for _, column := range []string{
+                "attempts INTEGER NOT NULL DEFAULT 0",
+                "next_attempt INTEGER NOT NULL DEFAULT 0",
+        } {
+                _, err := d.db.Exec("ALTER TABLE outbox ADD COLUMN " + column)
+                if err != nil && !strings.Contains(err.Error(), "duplicate column name") {
+                        return err
+                }
+        }
+        return nil
+}
+
+// Ping checks that the database can still be reached.
+func (d *Database) Ping(ctx context.Context) error {
+        return d.db.PingContext(ctx)
 }
 
 func (d *Database) IsSent(imageID string) (bool, error) {
@@ -47,3 +90,192 @@ func (d *Database) MarkSent(imageID string) error {
         _, err := d.db.Exec("INSERT OR IGNORE INTO sent_images(id) VALUES (?)", imageID)
         return err
 }
+
+func (d *Database) CountSent() (int, error) {
+        var n int
+        err := d.db.QueryRow("SELECT COUNT(*) FROM sent_images").Scan(&n)
+        return n, err
+}
+
+// BlockTag adds a tag to the blocklist. Tags are matched case-insensitively.
+func (d *Database) BlockTag(tag string) error {
+        _, err := d.db.Exec("INSERT OR IGNORE INTO blocked_tags(tag) VALUES (?)", strings.ToLower(strings.TrimSpace(tag)))
+        return err
+}
+
+func (d *Database) BlockedTags() ([]string, error) {
+        rows, err := d.db.Query("SELECT tag FROM blocked_tags ORDER BY tag")
+        if err != nil {
+                return nil, err
+        }
+        defer rows.Close()
+        var tags []string
+        for rows.Next() {
+                var tag string
+                if err := rows.Scan(&tag); err != nil {
+                        return nil, err
+                }
+                tags = append(tags, tag)
+        }
+        return tags, rows.Err()
+}
+
+// BlockedTag returns the first of the image's tags that is blocklisted, or "" if none is.
+func (d *Database) BlockedTag(img WallhavenImage) (string, error) {
+        blocked, err := d.BlockedTags()
+        if err != nil {
+                return "", err
+        }
+        for _, tag := range img.Tags {
+                if containsString(blocked, strings.ToLower(tag.Name)) {
+                        return tag.Name, nil
+                }
+        }
+        return "", nil
+}
+
+func (d *Database) AddFavourite(imageID string) error {
+        _, err := d.db.Exec("INSERT OR IGNORE INTO favourites(id) VALUES (?)", imageID)
+        return err
+}
+
+func (d *Database) CountFavourites() (int, error) {
+        var n int
+        err := d.db.QueryRow("SELECT COUNT(*) FROM favourites").Scan(&n)
+        return n, err
+}
+
+func (d *Database) SetPaused(paused bool) error {
+        value := "false"
+        if paused {
+                value = "true"
+        }
+        _, err := d.db.Exec("INSERT OR REPLACE INTO settings(key, value) VALUES ('paused', ?)", value)
+        return err
+}
+
+func (d *Database) IsPaused() (bool, error) {
+        var value string
+        err := d.db.QueryRow("SELECT value FROM settings WHERE key = 'paused'").Scan(&value)
+        if err == sql.ErrNoRows {
+                return false, nil
+        }
+        if err != nil {
+                return false, err
+        }
+        return value == "true", nil
+}
+
+// LastRun returns when the feed was last fetched, or the zero time if it never was.
+func (d *Database) LastRun(feed string) (time.Time, error) {
+        var value string
+        err := d.db.QueryRow("SELECT value FROM settings WHERE key = ?", "last_run:"+feed).Scan(&value)
+        if err == sql.ErrNoRows {
+                return time.Time{}, nil
+        }
+        if err != nil {
+                return time.Time{}, err
+        }
+        return time.Parse(time.RFC3339, value)
+}
+
+func (d *Database) SetLastRun(feed string, at time.Time) error {
+        _, err := d.db.Exec("INSERT OR REPLACE INTO settings(key, value) VALUES (?, ?)", "last_run:"+feed, at.UTC().Format(time.RFC3339))
+        return err
+}
+
+// OutboxItem is a prepared image waiting in the outbox.
+type OutboxItem struct {
+        Feed        string
+        Image       WallhavenImage
+        ImagePath   string
+        ThumbPath   string
+        Description string
+        QueuedAt    time.Time
+        Attempts    int // Failed releases so far
+}
+
+func (d *Database) Enqueue(item OutboxItem) error {
+        image, err := json.Marshal(item.Image)
+        if err != nil {
+                return err
+        }
+        _, err = d.db.Exec("INSERT OR IGNORE INTO outbox(id, feed, image, image_path, thumb_path, description, queued_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+                item.Image.ID, item.Feed, string(image), item.ImagePath, item.ThumbPath, item.Description, item.QueuedAt.Unix())
+        return err
+}
+
+// IsQueued reports whether the image has been put in the outbox, released or not.
+func (d *Database) IsQueued(imageID string) (bool, error) {
+        var id string
+        err := d.db.QueryRow("SELECT id FROM outbox WHERE id = ?", imageID).Scan(&id)
+        if err == sql.ErrNoRows {
+                return false, nil
+        }
+        if err != nil {
+                return false, err
+        }
+        return true, nil
+}
+
+// NextQueued returns the oldest unreleased outbox item that may be tried at
+// now, or nil if there is none. Items whose release failed wait until their
+// next attempt, so they don't hold up the rest of the queue.
+func (d *Database) NextQueued(now time.Time) (*OutboxItem, error) {
+        var item OutboxItem
+        var image string
+        var queuedAt int64
+        err := d.db.QueryRow("SELECT feed, image, image_path, thumb_path, description, queued_at, attempts FROM outbox WHERE released_at IS NULL AND next_attempt <= ? ORDER BY queued_at, rowid LIMIT 1", now.Unix()).
+                Scan(&item.Feed, &image, &item.ImagePath, &item.ThumbPath, &item.Description, &queuedAt, &item.Attempts)
+        if err == sql.ErrNoRows {
+                return nil, nil
+        }
+        if err != nil {
+                return nil, err
+        }
+        if err := json.Unmarshal([]byte(image), &item.Image); err != nil {
+                return nil, err
+        }
+        item.QueuedAt = time.Unix(queuedAt, 0)
+        return &item, nil
+}
+
+func (d *Database) MarkReleased(imageID string, at time.Time) error {
+        _, err := d.db.Exec("UPDATE outbox SET released_at = ? WHERE id = ?", at.Unix(), imageID)
+        return err
+}
+
+// PostponeQueued counts a failed release of the image and holds it back
+// until next.
+func (d *Database) PostponeQueued(imageID string, next time.Time) error {
+        _, err := d.db.Exec("UPDATE outbox SET attempts = attempts + 1, next_attempt = ? WHERE id = ?", next.Unix(), imageID)
+        return err
+}
+
+// Dequeue removes an image from the outbox without releasing it.
+func (d *Database) Dequeue(imageID string) error {
+        _, err := d.db.Exec("DELETE FROM outbox WHERE id = ?", imageID)
+        return err
+}
+
+func (d *Database) CountQueued() (int, error) {
+        var n int
+        err := d.db.QueryRow("SELECT COUNT(*) FROM outbox WHERE released_at IS NULL").Scan(&n)
+        return n, err
+}
+
+// LastRelease returns when the outbox last released an image, or the zero time if it never has.
+func (d *Database) LastRelease() (time.Time, error) {
+        var at sql.NullInt64
+        err := d.db.QueryRow("SELECT MAX(released_at) FROM outbox").Scan(&at)
+        if err != nil || !at.Valid {
+                return time.Time{}, err
+        }
+        return time.Unix(at.Int64, 0), nil
+}
+
+func (d *Database) CountReleasedSince(since time.Time) (int, error) {
+        var n int
+        err := d.db.QueryRow("SELECT COUNT(*) FROM outbox WHERE released_at >= ?", since.Unix()).Scan(&n)
+        return n, err
+}
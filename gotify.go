@@ -0,0 +1,54 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "io"
+    "net/http"
+    "strings"
+)
+
+// SendGotifyMessage posts a markdown message to Gotify with the wallpaper as
+// the notification's big image and a click-through to the wallhaven page.
+func SendGotifyMessage(cfg *Config, img WallhavenImage, message string) error {
+    bigImage := img.Thumbs.Large
+    if cfg.Gotify.FullImage || bigImage == "" {
+        bigImage = img.Path
+    }
+    body, err := json.Marshal(map[string]interface{}{
+        "title":    img.URL,
+        "message":  message,
+        "priority": cfg.Gotify.Priority,
+        "extras": map[string]interface{}{
+            "client::display": map[string]interface{}{
+                "contentType": "text/markdown",
+            },
+            "client::notification": map[string]interface{}{
+                "click":       map[string]interface{}{"url": img.URL},
+                "bigImageUrl": bigImage,
+            },
+        },
+    })
+    if err != nil {
+        return err
+    }
+
+    endpoint := fmt.Sprintf("%s/message", strings.TrimSuffix(cfg.Gotify.Server, "/"))
+    req, err := http.NewRequest("POST", endpoint, bytes.NewReader(body))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("X-Gotify-Key", cfg.Gotify.Token)
+    req.Header.Set("Content-Type", "application/json")
+    resp, err := doRequest("gotify", req, nil)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode >= 300 {
+        b, _ := io.ReadAll(resp.Body)
+        return fmt.Errorf("gotify message failed: %s - %s", resp.Status, redact(string(b)))
+    }
+    return nil
+}
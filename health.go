@@ -0,0 +1,193 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "sync"
+    "time"
+)
+
+// defaultFetchGrace is how long a scheduled fetch may be overdue before
+// /healthz fails, when health.fetch_grace isn't set.
+const defaultFetchGrace = 30 * time.Minute
+
+// healthState records the progress reported by /healthz and /readyz.
+type healthState struct {
+    mu           sync.Mutex
+    started      time.Time
+    lastFetch    map[string]time.Time // Last successful search per toprange
+    lastPublish  map[string]time.Time // Last successful publish per destination
+    backoffUntil time.Time            // End of the current rate-limit sleep
+    matrixBot    *MatrixBot
+}
+
+var health = &healthState{
+    started:     time.Now(),
+    lastFetch:   map[string]time.Time{},
+    lastPublish: map[string]time.Time{},
+}
+
+func (h *healthState) fetched(feed string) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    h.lastFetch[feed] = time.Now()
+}
+
+func (h *healthState) published(destination string) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    h.lastPublish[destination] = time.Now()
+}
+
+// backoff records that the process is sleeping for d because of a rate limit.
+func (h *healthState) backoff(d time.Duration) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    h.backoffUntil = time.Now().Add(d)
+}
+
+func (h *healthState) setMatrixBot(bot *MatrixBot) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    h.matrixBot = bot
+}
+
+// healthCheck is one line of the /healthz and /readyz reports.
+type healthCheck struct {
+    Name   string `json:"name"`
+    OK     bool   `json:"ok"`
+    Detail string `json:"detail,omitempty"`
+}
+
+// enabledDestinations lists the destinations images are published to.
+func enabledDestinations(cfg *Config) []string {
+    var destinations []string
+    if cfg.Matrix.Enabled {
+        destinations = append(destinations, "matrix")
+    }
+    if cfg.Mastodon.Enabled {
+        destinations = append(destinations, "mastodon")
+    }
+    if cfg.Ntfy.Enabled {
+        destinations = append(destinations, "ntfy")
+    }
+    if cfg.Gotify.Enabled {
+        destinations = append(destinations, "gotify")
+    }
+    if cfg.Webhook.Enabled {
+        destinations = append(destinations, "webhook")
+    }
+    return destinations
+}
+
+// HealthHandler serves /healthz: it fails if a toprange's fetch is overdue by
+// more than health.fetch_grace, or a destination hasn't been published to for
+// longer than health.max_publish_age.
+func HealthHandler(state *liveState) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        cfg, schedules, _ := state.get()
+        grace := time.Duration(cfg.Health.FetchGrace) * time.Minute
+        if grace <= 0 {
+            grace = defaultFetchGrace
+        }
+        maxPublishAge := time.Duration(cfg.Health.MaxPublishAge) * time.Minute
+        now := time.Now()
+        health.mu.Lock()
+        defer health.mu.Unlock()
+
+        var checks []healthCheck
+        for _, fs := range schedules {
+            last, ok := health.lastFetch[fs.feed]
+            since := last
+            if !ok {
+                since = health.started
+            }
+            due := fs.schedule.Next(since)
+            check := healthCheck{Name: "fetch:" + fs.feed, OK: now.Before(due.Add(grace))}
+            if ok {
+                check.Detail = "last success " + last.Format(time.RFC3339)
+            } else {
+                check.Detail = "no successful fetch since start"
+            }
+            if !check.OK {
+                check.Detail += fmt.Sprintf(", overdue since %s", due.Format(time.RFC3339))
+            }
+            checks = append(checks, check)
+        }
+        for _, destination := range enabledDestinations(cfg) {
+            last, ok := health.lastPublish[destination]
+            since := last
+            if !ok {
+                since = health.started
+            }
+            check := healthCheck{Name: "publish:" + destination, OK: maxPublishAge <= 0 || now.Sub(since) <= maxPublishAge}
+            if ok {
+                check.Detail = "last success " + last.Format(time.RFC3339)
+            } else {
+                check.Detail = "no successful publish since start"
+            }
+            checks = append(checks, check)
+        }
+        if now.Before(health.backoffUntil) {
+            checks = append(checks, healthCheck{Name: "rate_limit", OK: true, Detail: "backing off until " + health.backoffUntil.Format(time.RFC3339)})
+        }
+        writeHealth(w, checks)
+    }
+}
+
+// ReadyHandler serves /readyz: it fails if the database is unreachable, the
+// Matrix access token is rejected or a rate-limit backoff is in progress.
+func ReadyHandler(db *Database) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+        defer cancel()
+
+        var checks []healthCheck
+        dbCheck := healthCheck{Name: "database", OK: true}
+        if err := db.Ping(ctx); err != nil {
+            dbCheck.OK, dbCheck.Detail = false, redact(err.Error())
+        }
+        checks = append(checks, dbCheck)
+
+        health.mu.Lock()
+        bot, backoffUntil := health.matrixBot, health.backoffUntil
+        health.mu.Unlock()
+
+        if bot != nil {
+            matrixCheck := healthCheck{Name: "matrix", OK: true}
+            if whoami, err := bot.client.Whoami(ctx); err != nil {
+                matrixCheck.OK, matrixCheck.Detail = false, redact(err.Error())
+            } else {
+                matrixCheck.Detail = whoami.UserID.String()
+            }
+            checks = append(checks, matrixCheck)
+        }
+
+        rateCheck := healthCheck{Name: "rate_limit", OK: !time.Now().Before(backoffUntil)}
+        if !rateCheck.OK {
+            rateCheck.Detail = "backing off until " + backoffUntil.Format(time.RFC3339)
+        }
+        checks = append(checks, rateCheck)
+        writeHealth(w, checks)
+    }
+}
+
+// writeHealth writes the checks as JSON, with status 503 if any failed.
+func writeHealth(w http.ResponseWriter, checks []healthCheck) {
+    status := "ok"
+    for _, check := range checks {
+        if !check.OK {
+            status = "fail"
+        }
+    }
+    w.Header().Set("Content-Type", "application/json")
+    if status != "ok" {
+        w.WriteHeader(http.StatusServiceUnavailable)
+    }
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "status": status,
+        "checks": checks,
+    })
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+    "crypto/tls"
+    "crypto/x509"
+    "fmt"
+    "log/slog"
+    "math/rand"
+    "net/http"
+    "net/url"
+    "os"
+    "strconv"
+    "sync"
+    "time"
+)
+
+const (
+    defaultUserAgent  = "WallhavenDaily/1.0"
+    defaultMaxRetries = 3
+    defaultRetryWait  = time.Second
+    maxRetryWait      = time.Minute
+)
+
+// serviceTimeouts are the default request timeouts per outbound service; the
+// timeout covers the whole exchange, including reading the body.
+var serviceTimeouts = map[string]time.Duration{
+    "wallhaven": 15 * time.Second,
+    "download":  2 * time.Minute,
+    "openai":    time.Minute,
+    "mastodon":  time.Minute,
+    "ntfy":      time.Minute,
+    "gotify":    15 * time.Second,
+    "webhook":   15 * time.Second,
+    "matrix":    3 * time.Minute, // Must stay above the /sync long-poll timeout
+}
+
+// outbound is the HTTP layer shared by every outbound request: one pooled
+// transport with the configured proxy and CA bundle, plus retry settings.
+var outbound = struct {
+    mu        sync.RWMutex
+    transport *http.Transport
+    cfg       *Config
+}{
+    transport: http.DefaultTransport.(*http.Transport).Clone(),
+    cfg:       &Config{},
+}
+
+// setupHTTPClient applies the http_client settings. Clients handed out before
+// keep the previous transport.
+func setupHTTPClient(cfg *Config) error {
+    transport, err := newHTTPTransport(cfg)
+    if err != nil {
+        return err
+    }
+    outbound.mu.Lock()
+    defer outbound.mu.Unlock()
+    outbound.transport, outbound.cfg = transport, cfg
+    return nil
+}
+
+// newHTTPTransport builds a pooled transport that uses the configured proxy
+// (or the HTTP_PROXY/HTTPS_PROXY environment) and trusts the extra CAs.
+func newHTTPTransport(cfg *Config) (*http.Transport, error) {
+    c := cfg.HTTPClient
+    transport := http.DefaultTransport.(*http.Transport).Clone()
+    transport.MaxIdleConnsPerHost = 8
+    transport.Proxy = http.ProxyFromEnvironment
+    if c.Proxy != "" {
+        proxyURL, err := url.Parse(c.Proxy)
+        if err != nil {
+            return nil, fmt.Errorf("proxy: %w", err)
+        }
+        switch proxyURL.Scheme {
+        case "http", "https", "socks5", "socks5h":
+        default:
+            return nil, fmt.Errorf("proxy %q: scheme must be http, https or socks5", c.Proxy)
+        }
+        transport.Proxy = http.ProxyURL(proxyURL)
+    }
+    if c.CAFile != "" {
+        pem, err := os.ReadFile(c.CAFile)
+        if err != nil {
+            return nil, fmt.Errorf("ca_file: %w", err)
+        }
+        pool, err := x509.SystemCertPool()
+        if err != nil {
+            pool = x509.NewCertPool()
+        }
+        if !pool.AppendCertsFromPEM(pem) {
+            return nil, fmt.Errorf("ca_file %s: no PEM certificates found", c.CAFile)
+        }
+        transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+    }
+    return transport, nil
+}
+
+// httpClient returns a client for the service, sharing the pooled transport
+// and using the service's timeout.
+func httpClient(service string) *http.Client {
+    outbound.mu.RLock()
+    defer outbound.mu.RUnlock()
+    timeout := serviceTimeouts[service]
+    if seconds := outbound.cfg.HTTPClient.Timeouts[service]; seconds > 0 {
+        timeout = time.Duration(seconds) * time.Second
+    }
+    return &http.Client{Transport: outbound.transport, Timeout: timeout}
+}
+
+// doRequest sends the request with the service's client, setting the default
+// User-Agent if the request has none. Services with a limiter wait for it
+// before every attempt, and every 429 pauses the limiter for all callers.
+// Responses with status 429 or 503 are retried for any request; other 5xx and network errors only for GET and
+// HEAD requests or ones with an Idempotency-Key, so nothing is posted twice.
+// Waits grow exponentially with jitter, or follow Retry-After. observe, if not
+// nil, is called with every response (nil if the request failed). The last
+// response is returned whatever its status.
+func doRequest(service string, req *http.Request, observe func(*http.Response)) (*http.Response, error) {
+    outbound.mu.RLock()
+    c := outbound.cfg.HTTPClient
+    outbound.mu.RUnlock()
+    maxRetries := c.MaxRetries
+    if maxRetries == 0 {
+        maxRetries = defaultMaxRetries
+    }
+    wait := time.Duration(c.RetryWait) * time.Second
+    if wait <= 0 {
+        wait = defaultRetryWait
+    }
+    userAgent := c.UserAgent
+    if userAgent == "" {
+        userAgent = defaultUserAgent
+    }
+    if req.Header.Get("User-Agent") == "" {
+        req.Header.Set("User-Agent", userAgent)
+    }
+
+    client := httpClient(service)
+    limiter := serviceLimiters[service]
+    // A body can only be sent again if it can be recreated
+    rewindable := req.Body == nil || req.GetBody != nil
+    idempotent := req.Method == http.MethodGet || req.Method == http.MethodHead || req.Header.Get("Idempotency-Key") != ""
+    for attempt := 0; ; attempt++ {
+        if attempt > 0 && req.GetBody != nil {
+            body, err := req.GetBody()
+            if err != nil {
+                return nil, err
+            }
+            req.Body = body
+        }
+        if limiter != nil {
+            if err := limiter.Wait(req.Context()); err != nil {
+                return nil, err
+            }
+        }
+        resp, err := client.Do(req)
+        if observe != nil {
+            observe(resp)
+        }
+        // Hold back every caller of a rate-limited service, not just this one,
+        // whether or not this request is retried
+        if limiter != nil && err == nil && resp.StatusCode == http.StatusTooManyRequests {
+            limiter.Pause(rateLimitDelay(resp))
+        }
+
+        var retry bool
+        switch {
+        case err != nil:
+            retry = idempotent && req.Context().Err() == nil
+        case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable:
+            retry = true
+        case resp.StatusCode >= 500:
+            retry = idempotent
+        }
+        if !retry || !rewindable || maxRetries < 0 || attempt >= maxRetries {
+            return resp, err
+        }
+
+        delay := backoffDelay(wait, attempt)
+        if resp != nil {
+            if after, ok := retryAfter(resp); ok {
+                delay = after
+            } else if resp.StatusCode == http.StatusTooManyRequests {
+                delay = maxRetryWait
+            }
+            resp.Body.Close()
+        }
+        logger := slog.With("service", service, "host", req.URL.Host, "attempt", attempt+1, "max_attempts", maxRetries+1, "retry_in", delay.Round(time.Millisecond))
+        if err != nil {
+            logger.Warn("HTTP request failed, retrying", "error", err)
+        } else {
+            logger.Warn("HTTP request failed, retrying", "status", resp.StatusCode)
+        }
+        select {
+        case <-time.After(delay):
+        case <-req.Context().Done():
+            return nil, req.Context().Err()
+        }
+    }
+}
+
+// backoffDelay doubles the base wait for every attempt, up to maxRetryWait,
+// and spreads it by ±50% so clients don't retry in lockstep.
+func backoffDelay(base time.Duration, attempt int) time.Duration {
+    delay := base << uint(attempt)
+    if delay > maxRetryWait || delay <= 0 {
+        delay = maxRetryWait
+    }
+    return delay/2 + time.Duration(rand.Int63n(int64(delay)))
+}
+
+// rateLimitDelay is how long to wait after a 429: Retry-After, or
+// maxRetryWait if the server didn't say.
+func rateLimitDelay(resp *http.Response) time.Duration {
+    if after, ok := retryAfter(resp); ok {
+        return after
+    }
+    return maxRetryWait
+}
+
+// retryAfter parses the Retry-After header, given in seconds or as a date.
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+    value := resp.Header.Get("Retry-After")
+    if value == "" {
+        return 0, false
+    }
+    if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+        return time.Duration(seconds) * time.Second, true
+    }
+    if at, err := http.ParseTime(value); err == nil {
+        if d := time.Until(at); d > 0 {
+            return d, true
+        }
+        return 0, true
+    }
+    return 0, false
+}
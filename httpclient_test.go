@@ -0,0 +1,119 @@
+package main
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+func TestRetryAfter(t *testing.T) {
+    tests := []struct {
+        name   string
+        header string
+        want   time.Duration
+        wantOK bool
+    }{
+        {"missing", "", 0, false},
+        {"seconds", "5", 5 * time.Second, true},
+        {"zero", "0", 0, true},
+        {"negative", "-1", 0, false},
+        {"garbage", "soon", 0, false},
+        {"past date", time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), 0, true},
+    }
+    for _, tt := range tests {
+        resp := &http.Response{Header: http.Header{}}
+        if tt.header != "" {
+            resp.Header.Set("Retry-After", tt.header)
+        }
+        got, ok := retryAfter(resp)
+        if got != tt.want || ok != tt.wantOK {
+            t.Errorf("%s: retryAfter(%q) = %s, %v, want %s, %v", tt.name, tt.header, got, ok, tt.want, tt.wantOK)
+        }
+    }
+
+    // A date is relative to now, so only check it is close
+    resp := &http.Response{Header: http.Header{}}
+    resp.Header.Set("Retry-After", time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+    if got, ok := retryAfter(resp); !ok || got < 58*time.Second || got > time.Minute {
+        t.Errorf("retryAfter(date in a minute) = %s, %v", got, ok)
+    }
+}
+
+func TestBackoffDelay(t *testing.T) {
+    tests := []struct {
+        base    time.Duration
+        attempt int
+        nominal time.Duration // Before jitter
+    }{
+        {time.Second, 0, time.Second},
+        {time.Second, 1, 2 * time.Second},
+        {time.Second, 3, 8 * time.Second},
+        {time.Second, 10, maxRetryWait},
+        {time.Second, 70, maxRetryWait}, // Shift overflow
+        {2 * time.Minute, 0, maxRetryWait},
+    }
+    for _, tt := range tests {
+        for i := 0; i < 20; i++ {
+            got := backoffDelay(tt.base, tt.attempt)
+            if got < tt.nominal/2 || got >= tt.nominal*3/2 {
+                t.Errorf("backoffDelay(%s, %d) = %s, want within ±50%% of %s", tt.base, tt.attempt, got, tt.nominal)
+                break
+            }
+        }
+    }
+}
+
+func TestDoRequestRetries(t *testing.T) {
+    if err := setupHTTPClient(&Config{}); err != nil {
+        t.Fatal(err)
+    }
+    tests := []struct {
+        name           string
+        method         string
+        idempotencyKey bool
+        statuses       []int // Returned in turn; the last one repeats
+        wantCalls      int32
+        wantStatus     int
+    }{
+        {"GET retried after 503", "GET", false, []int{503, 200}, 2, 200},
+        {"GET retried after 500", "GET", false, []int{500, 200}, 2, 200},
+        {"GET gives up after max retries", "GET", false, []int{500}, defaultMaxRetries + 1, 500},
+        {"client errors aren't retried", "GET", false, []int{404}, 1, 404},
+        {"POST retried after 429", "POST", false, []int{429, 200}, 2, 200},
+        {"POST not retried after 500", "POST", false, []int{500, 200}, 1, 500},
+        {"POST with Idempotency-Key retried after 502", "POST", true, []int{502, 200}, 2, 200},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            var calls int32
+            server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                n := int(atomic.AddInt32(&calls, 1)) - 1
+                if n >= len(tt.statuses) {
+                    n = len(tt.statuses) - 1
+                }
+                w.Header().Set("Retry-After", "0") // Keep the test fast
+                w.WriteHeader(tt.statuses[n])
+            }))
+            defer server.Close()
+
+            req, err := http.NewRequest(tt.method, server.URL, strings.NewReader("body"))
+            if err != nil {
+                t.Fatal(err)
+            }
+            if tt.idempotencyKey {
+                req.Header.Set("Idempotency-Key", "key")
+            }
+            resp, err := doRequest("webhook", req, nil)
+            if err != nil {
+                t.Fatal(err)
+            }
+            resp.Body.Close()
+            if resp.StatusCode != tt.wantStatus || calls != tt.wantCalls {
+                t.Errorf("got status %d after %d calls, want %d after %d", resp.StatusCode, calls, tt.wantStatus, tt.wantCalls)
+            }
+        })
+    }
+}
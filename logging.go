@@ -0,0 +1,53 @@
+package main
+
+import (
+    "crypto/rand"
+    "encoding/hex"
+    "fmt"
+    "log/slog"
+    "os"
+    "strings"
+)
+
+// setupLogging installs the default slog logger from the logging settings.
+// The standard log package, used by some dependencies, goes through it too,
+// and every line has the configured secrets scrubbed.
+func setupLogging(cfg *Config) error {
+    level := slog.LevelInfo
+    if cfg.Debug {
+        level = slog.LevelDebug
+    }
+    if cfg.Logging.Level != "" {
+        if err := level.UnmarshalText([]byte(cfg.Logging.Level)); err != nil {
+            return fmt.Errorf("logging level: %w", err)
+        }
+    }
+    addConfigSecrets(cfg)
+    opts := &slog.HandlerOptions{Level: level, ReplaceAttr: redactAttr}
+
+    var handler slog.Handler
+    switch strings.ToLower(cfg.Logging.Format) {
+    case "", "text":
+        handler = slog.NewTextHandler(os.Stderr, opts)
+    case "json":
+        handler = slog.NewJSONHandler(os.Stderr, opts)
+    default:
+        return fmt.Errorf("logging format %q is not text or json", cfg.Logging.Format)
+    }
+    slog.SetDefault(slog.New(handler))
+    return nil
+}
+
+// fatal logs an error and exits, like log.Fatalf.
+func fatal(msg string, args ...any) {
+    slog.Error(msg, args...)
+    os.Exit(1)
+}
+
+// newRunID returns a short random ID that ties together the log lines of one
+// pass of the main loop.
+func newRunID() string {
+    b := make([]byte, 4)
+    rand.Read(b)
+    return hex.EncodeToString(b)
+}
@@ -1,7 +1,10 @@
 package main
 
 import (
-    "log"
+    "errors"
+    "fmt"
+    "log/slog"
+    "net/http"
     "os"
     "sync"
     "path/filepath"
@@ -12,7 +15,7 @@ import (
 func main() {
     exePath, err := os.Executable()
     if err != nil {
-        log.Fatalf("Failed to get executable path: %v", err)
+        fatal("Failed to get executable path", "error", err)
     }
     exeDir := filepath.Dir(exePath)
 
@@ -21,178 +24,413 @@ func main() {
         // Use the directory of the main.go (assume it's where the config is)
         cwd, err := os.Getwd()
         if err != nil {
-            log.Fatalf("Failed to get working directory: %v", err)
+            fatal("Failed to get working directory", "error", err)
         }
         exeDir = cwd
     }
 
-    if err := os.Chdir(exeDir); err != nil {
-        log.Fatalf("Failed to change working directory: %v", err)
+    // "config check [file]" validates the config and exits; a file given on
+    // the command line is relative to where we were started
+    checkConfig := len(os.Args) > 2 && os.Args[1] == "config" && os.Args[2] == "check"
+    configFile := "config.yaml"
+    if checkConfig && len(os.Args) > 3 {
+        if configFile, err = filepath.Abs(os.Args[3]); err != nil {
+            fatal("Invalid config path", "error", err)
+        }
     }
 
-    log.Printf("Switch to dir: %v", exeDir)
+    if err := os.Chdir(exeDir); err != nil {
+        fatal("Failed to change working directory", "error", err)
+    }
+    if checkConfig {
+        os.Exit(runConfigCheck(configFile))
+    }
 
     cfg, err := LoadConfig("config.yaml")
     if err != nil {
-        log.Fatalf("Failed to load config: %v", err)
+        fatal("Failed to load config", "error", err)
+    }
+    if err := setupLogging(cfg); err != nil {
+        fatal("Invalid logging settings", "error", err)
+    }
+    if err := setupHTTPClient(cfg); err != nil {
+        fatal("Invalid http_client settings", "error", err)
+    }
+    wallhavenLimiter.SetRate(cfg.Wallhaven.RateLimit)
+    slog.Info("Switched to directory", "dir", exeDir)
+
+    if len(os.Args) > 1 {
+        switch os.Args[1] {
+        case "generate-registration":
+            if err := GenerateAppserviceRegistration(cfg); err != nil {
+                fatal("Failed to generate appservice registration", "error", err)
+            }
+            return
+        case "cache":
+            if len(os.Args) != 3 || os.Args[2] != "clear" {
+                fatal("Unknown cache command, expected \"cache clear\"")
+            }
+            if err := ClearAPICache(cfg); err != nil {
+                fatal("Failed to clear the API cache", "error", err)
+            }
+            return
+        default:
+            fatal("Unknown command", "command", os.Args[1])
+        }
     }
 
     db, err := NewDatabase(cfg.Database)
     if err != nil {
-        log.Fatalf("Failed to open database: %v", err)
+        fatal("Failed to open database", "error", err)
     }
 
-    var matrixBot *MatrixBot
+    schedules, err := cfg.FeedSchedules()
+    if err != nil {
+        fatal("Invalid schedule", "error", err)
+    }
+    state := &liveState{filename: "config.yaml", cfg: cfg, schedules: schedules}
+
+    mux := http.NewServeMux()
+    mux.Handle("/ntfy/favourite", NtfyFavouriteHandler(state, db))
+    mux.Handle("/metrics", MetricsHandler())
+    mux.Handle("/healthz", HealthHandler(state))
+    mux.Handle("/readyz", ReadyHandler(db))
+    registerQueueMetric(db)
+    if cfg.Webhook.VariantsDir != "" {
+        mux.Handle("/variants/", VariantsHandler(cfg.Webhook.VariantsDir))
+        ttl := time.Duration(cfg.Webhook.VariantsTTLHours) * time.Hour
+        if ttl <= 0 {
+            ttl = 24 * time.Hour
+        }
+        go PruneVariants(cfg.Webhook.VariantsDir, ttl)
+    }
+    startHTTPServer(cfg, mux)
+    go PruneAPICache(state)
+
     if cfg.Matrix.Enabled {
-        var err error
-        matrixBot, err = NewMatrixBot(cfg)
+        matrixBot, err := startMatrixBot(cfg, db)
         if err != nil {
-            log.Fatalf("Matrix login failed: %v", err)
+            fatal("Matrix login failed", "error", err)
         }
-        log.Printf("Matrix posting enabled")
+        state.matrixBot = matrixBot
+        health.setMatrixBot(matrixBot)
+        slog.Info("Matrix posting enabled")
     } else {
-        log.Printf("Matrix posting disabled")
+        slog.Info("Matrix posting disabled")
     }
 
+    // The config is swapped only here, between runs, so a run never sees
+    // a mix of old and new settings
+    reloads := watchReloads(state)
+    outboxStarted := false
+    // Feeds whose fetch failed are retried after fetchRetryDelay rather than
+    // waiting for their next scheduled run
+    retryAt := map[string]time.Time{}
     for {
-        for i, rangeOpt := range cfg.Wallhaven.Toprange {
-            log.Printf("Fetching images for range: %s", rangeOpt)
-            imageIDs, rateLimitInfo, err := cfg.FetchNewWallhavenImageIDs(db, rangeOpt)
-            if err != nil {
-                log.Printf("Failed to fetch image IDs for range %s: %v", rangeOpt, err)
+        select {
+        case <-reloads:
+            state.reload(db)
+        default:
+        }
+        cfg, schedules, matrixBot := state.get()
+        if cfg.Outbox.Enabled && !outboxStarted {
+            outboxStarted = true
+            go RunOutbox(state, db)
+        }
+
+        now := time.Now()
+        var due []string
+        var next time.Time
+        for _, fs := range schedules {
+            at := fs.nextRun(db, now)
+            if retry, ok := retryAt[fs.feed]; ok && retry.After(at) {
+                at = retry
+            }
+            if !at.After(now) {
+                due = append(due, fs.feed)
                 continue
             }
-            
-            log.Printf("Found %d new images to process for range %s", len(imageIDs), rangeOpt)
-            
-            // Process images in parallel with rate limit awareness
-            maxWorkers := cfg.MaxConcurrentImages
-            if maxWorkers <= 0 {
-                maxWorkers = 3 // Default to 3 concurrent images
+            if next.IsZero() || at.Before(next) {
+                next = at
             }
-            log.Printf("Processing %d images with %d concurrent workers", len(imageIDs), maxWorkers)
-            
-            // Create a semaphore to limit concurrent workers
-            semaphore := make(chan struct{}, maxWorkers)
-            var wg sync.WaitGroup
-            
-            for _, imageID := range imageIDs {
-                wg.Add(1)
-                semaphore <- struct{}{} // Acquire a slot
-                
-                go func(id string) {
-                    defer wg.Done()
-                    defer func() { <-semaphore }() // Release the slot
-                    processAndSendImage(cfg, db, matrixBot, id)
-                }(imageID)
+        }
+        if len(due) > 0 {
+            logger := slog.With("run_id", newRunID())
+            start := time.Now()
+            logger.Info("Run started", "toprange", due)
+            failed := runFeeds(cfg, db, matrixBot, logger, due)
+            for _, feed := range due {
+                delete(retryAt, feed)
             }
-            
-            wg.Wait() // Wait for all images to be processed
-            log.Printf("Completed processing all images for range %s", rangeOpt)
-            
-            // Add adaptive delay between search API calls based on rate limit remaining
-            if i < len(cfg.Wallhaven.Toprange)-1 {
-                delay := CalculateAdaptiveDelay(rateLimitInfo.Remaining, rateLimitInfo.Limit)
-                log.Printf("Rate limit: %d/%d remaining. Waiting %d seconds before next search API call...", 
-                    rateLimitInfo.Remaining, rateLimitInfo.Limit, delay)
-                time.Sleep(time.Duration(delay) * time.Second)
+            for _, feed := range failed {
+                retryAt[feed] = time.Now().Add(fetchRetryDelay)
+            }
+            logger.Info("Run finished", "duration", time.Since(start).Round(time.Second))
+            continue
+        }
+        slog.Info("Waiting for next fetch", "next", next.Format(time.RFC3339))
+        select {
+        case <-time.After(time.Until(next)):
+        case <-reloads:
+            state.reload(db)
+        }
+    }
+}
+
+// fetchRetryDelay is how long to wait before fetching a feed again after its
+// search failed.
+const fetchRetryDelay = 5 * time.Minute
+
+// runFeeds fetches and processes new images for each of the given toprange
+// values and records each successful fetch, so a restart doesn't fetch them
+// again early. It returns the feeds whose fetch failed.
+func runFeeds(cfg *Config, db *Database, matrixBot *MatrixBot, logger *slog.Logger, feeds []string) (failed []string) {
+    if paused, err := db.IsPaused(); err != nil {
+        logger.Error("Failed to read paused state", "error", err)
+    } else if paused {
+        logger.Info("Posting is paused, skipping this run")
+        for _, feed := range feeds {
+            health.fetched(feed) // Paused is idle, not stuck
+            if err := db.SetLastRun(feed, time.Now()); err != nil {
+                logger.Error("Failed to save last run", "toprange", feed, "error", err)
             }
         }
+        return
+    }
 
-        logWait(cfg.WaitTime)
+    for _, rangeOpt := range feeds {
+        rangeLog := logger.With("toprange", rangeOpt)
+        rangeLog.Info("Fetching images")
+        fetchedAt := time.Now()
+        images, err := cfg.FetchNewWallhavenImages(db, rangeOpt)
+        if err != nil {
+            rangeLog.Error("Failed to fetch images, retrying later", "error", err, "retry_in", fetchRetryDelay)
+            failed = append(failed, rangeOpt)
+            continue
+        }
+        if err := db.SetLastRun(rangeOpt, fetchedAt); err != nil {
+            rangeLog.Error("Failed to save last run", "error", err)
+        }
+        health.fetched(rangeOpt)
+        
+        // Process images in parallel; wallhavenLimiter paces their API calls
+        maxWorkers := cfg.MaxConcurrentImages
+        if maxWorkers <= 0 {
+            maxWorkers = 3 // Default to 3 concurrent images
+        }
+        rangeLog.Info("Processing new images", "count", len(images), "workers", maxWorkers)
+        
+        // Create a semaphore to limit concurrent workers
+        semaphore := make(chan struct{}, maxWorkers)
+        var wg sync.WaitGroup
+        
+        for _, image := range images {
+            wg.Add(1)
+            semaphore <- struct{}{} // Acquire a slot
+            
+            go func(img WallhavenImage) {
+                defer wg.Done()
+                defer func() { <-semaphore }() // Release the slot
+                processAndSendImage(cfg, db, matrixBot, logger, rangeOpt, img)
+            }(image)
+        }
+        
+        wg.Wait() // Wait for all images to be processed
+        rangeLog.Info("Completed processing all images")
     }
+    return failed
 }
 
-func processAndSendImage(cfg *Config, db *Database, matrixBot *MatrixBot, imageID string) {
-    log.Printf("Processing image %s", imageID)
+func processAndSendImage(cfg *Config, db *Database, matrixBot *MatrixBot, logger *slog.Logger, feed string, img WallhavenImage) {
+    logger = logger.With("feed", feed, "image_id", img.ID)
+    logger.Debug("Processing image")
     
-    // Fetch full image details
-    img, err := FetchWallhavenImage(cfg, imageID)
+    // The search result has everything but the uploader and tags
+    img, err := imageDetails(cfg, db, img)
     if err != nil {
-        log.Printf("Not sending image %s: failed to fetch image info: %v", imageID, err)
+        logger.Warn("Not sending image: failed to fetch image info", "error", err)
+        imagesFiltered.WithLabelValues("fetch_failed").Inc()
         return
     }
     
-    log.Printf("Processing image %s (Path: %s)", img.ID, img.Path)
+    logger.Info("Processing image", "path", img.Path)
 
-    // Validate URL before attempting download
-    if img.Path == "" {
-        log.Printf("Not sending image %s to Matrix/Mastodon/ntfy: image URL (Path) is empty", img.ID)
+    // Skip images carrying a blocklisted tag, and don't look at them again
+    if tag, err := db.BlockedTag(img); err != nil {
+        logger.Error("Failed to check blocklist", "error", err)
+    } else if tag != "" {
+        logger.Info("Not sending image: tag is blocklisted", "tag", tag)
+        imagesFiltered.WithLabelValues("blocked_tag").Inc()
+        if err := db.MarkSent(img.ID); err != nil {
+            logger.Error("Failed to mark image as sent", "error", err)
+        }
         return
     }
 
-    // Download full image for Matrix, Mastodon, ntfy and for creating our thumbnail
-    imagePath, err := DownloadToTempFile(img.Path, "image")
+    prepared, err := prepareImage(cfg, logger, img)
     if err != nil {
-        log.Printf("Not sending image %s to Matrix/Mastodon/ntfy: could not download full image from %s: %v", img.ID, img.Path, err)
+        logger.Warn("Not sending image to any destination", "error", err)
+        imagesFiltered.WithLabelValues("prepare_failed").Inc()
         return
     }
-    defer os.Remove(imagePath)
 
-    // Create our own thumbnail (800px max dimension) from full image; used for OpenAI and Matrix
-    thumbPath, err := CreateThumbnailMax800(imagePath)
-    if err != nil {
-        log.Printf("Not sending image %s: could not create thumbnail: %v", img.ID, err)
+    if cfg.Outbox.Enabled {
+        if err := enqueueImage(cfg, db, feed, prepared); err != nil {
+            logger.Error("Failed to queue image", "error", err)
+            prepared.Cleanup()
+            return
+        }
+        logger.Info("Queued image in the outbox")
         return
     }
-    defer os.Remove(thumbPath)
+    defer prepared.Cleanup()
+    sendPreparedImage(cfg, db, matrixBot, logger, feed, prepared)
+}
 
-    // OpenAI Description (using our 800px thumbnail)
-    openaiDescription, err := GetOpenAIDescription(cfg, thumbPath)
-    if err != nil {
-        log.Printf("OpenAI error: %v", err)
-        openaiDescription = ""
-    }
+// sendPreparedImage posts the image to every enabled destination in parallel
+// and marks it as sent unless every enabled destination failed, which it
+// reports.
+func sendPreparedImage(cfg *Config, db *Database, matrixBot *MatrixBot, logger *slog.Logger, feed string, prepared *preparedImage) (allFailed bool) {
+    img := prepared.Image
+    imagePath, thumbPath, openaiDescription := prepared.ImagePath, prepared.ThumbPath, prepared.Description
 
-    // Parallel posting to enabled services (Matrix, Mastodon, ntfy)
+    // Parallel posting to enabled services (Matrix, Mastodon, ntfy, Gotify, webhook)
     var postWg sync.WaitGroup
-    enabledServices := 0
-
-    if cfg.Matrix.Enabled && matrixBot != nil {
+    var resultMu sync.Mutex
+    enabledServices, published, skipped := 0, 0, 0
+    publish := func(destination string, send func() error) {
         postWg.Add(1)
         enabledServices++
         go func() {
             defer postWg.Done()
-            if err := matrixBot.SendImage(img, cfg, openaiDescription, imagePath, thumbPath); err != nil {
-                log.Printf("Failed to send image %s to Matrix: %v", img.ID, err)
+            start := time.Now()
+            err := redactError(send())
+            if errors.Is(err, errNoMatrixTarget) {
+                resultMu.Lock()
+                skipped++
+                resultMu.Unlock()
+                return
+            }
+            observePublish(destination, start, err)
+            destLog := logger.With("destination", destination, "duration", time.Since(start).Round(time.Millisecond))
+            if err != nil {
+                destLog.Error("Failed to publish image", "error", err)
+                return
             }
+            destLog.Info("Published image")
+            resultMu.Lock()
+            published++
+            resultMu.Unlock()
         }()
     }
-    
+
+    if cfg.Matrix.Enabled && matrixBot != nil {
+        publish("matrix", func() error {
+            return matrixBot.SendImage(img, cfg, feed, openaiDescription, imagePath, thumbPath)
+        })
+    }
     if cfg.Mastodon.Enabled {
-        postWg.Add(1)
-        enabledServices++
-        go func() {
-            defer postWg.Done()
-            if err := PostToMastodon(cfg, img, openaiDescription, imagePath); err != nil {
-                log.Printf("Failed to post image %s to Mastodon: %v", img.ID, err)
-            }
-        }()
+        publish("mastodon", func() error {
+            return PostToMastodon(cfg, img, feed, openaiDescription, imagePath)
+        })
     }
-    
     if cfg.Ntfy.Enabled {
-        postWg.Add(1)
-        enabledServices++
-        go func() {
-            defer postWg.Done()
-            ntfyStatus := BuildNtfyStatus(img, openaiDescription)
-            ntfyTags := NtfyTags(img)
-            if err := SendNtfyImageNotification(cfg, imagePath, ntfyStatus, ntfyTags, img.URL); err != nil {
-                log.Printf("Failed to send ntfy notification for %s: %v", img.ID, err)
+        publish("ntfy", func() error {
+            ntfyStatus, err := renderTemplate(cfg.Templates.Ntfy, img, openaiDescription, feed)
+            if err != nil {
+                return fmt.Errorf("rendering template: %w", err)
             }
-        }()
+            var tags []string
+            if cfg.Ntfy.WallhavenTags {
+                tags = NtfyTags(img)
+            }
+            return SendNtfyImageNotification(cfg, img, feed, imagePath, thumbPath, ntfyStatus, tags)
+        })
+    }
+    if cfg.Gotify.Enabled {
+        publish("gotify", func() error {
+            message, err := renderTemplate(cfg.Templates.Gotify, img, openaiDescription, feed)
+            if err != nil {
+                return fmt.Errorf("rendering template: %w", err)
+            }
+            return SendGotifyMessage(cfg, img, message)
+        })
+    }
+    if cfg.Webhook.Enabled {
+        publish("webhook", func() error {
+            return SendWebhook(cfg, img, feed, openaiDescription, imagePath, thumbPath)
+        })
     }
 
     if enabledServices > 0 {
         postWg.Wait()
     } else {
-        log.Printf("Warning: All services are disabled, image %s will not be sent anywhere", img.ID)
+        logger.Warn("All services are disabled, image will not be sent anywhere")
     }
 
-    // Mark as sent in the DB
+    // Only an image published somewhere counts as sent; otherwise it is
+    // tried again, from the outbox or the next fetch
+    if enabledServices > skipped && published == 0 {
+        logger.Error("Every destination failed, not marking image as sent")
+        return true
+    }
     if err := db.MarkSent(img.ID); err != nil {
-        log.Printf("Failed to mark image %s as sent: %v", img.ID, err)
+        logger.Error("Failed to mark image as sent", "error", err)
+    } else {
+        logger.Info("Sent image to all enabled destinations and marked as sent")
+    }
+    return false
+}
+
+// preparedImage holds the local files and AI description shared by every destination.
+type preparedImage struct {
+    Image       WallhavenImage
+    ImagePath   string
+    ThumbPath   string
+    Description string
+}
+
+// prepareImage downloads the full image, creates our 800px thumbnail and asks
+// OpenAI for a description. Call Cleanup to remove the temp files.
+func prepareImage(cfg *Config, logger *slog.Logger, img WallhavenImage) (*preparedImage, error) {
+    // Validate URL before attempting download
+    if img.Path == "" {
+        return nil, fmt.Errorf("image URL (Path) is empty")
+    }
+
+    // Download full image for Matrix, Mastodon, ntfy and for creating our thumbnail
+    imagePath, err := DownloadToTempFile(img.Path, "image", int64(img.FileSize))
+    if err != nil {
+        return nil, fmt.Errorf("could not download full image from %s: %w", img.Path, err)
+    }
+
+    // Create our own thumbnail (800px max dimension) from full image; used for OpenAI and Matrix
+    thumbPath, err := CreateThumbnailMax800(imagePath)
+    if err != nil {
+        os.Remove(imagePath)
+        return nil, fmt.Errorf("could not create thumbnail: %w", err)
+    }
+
+    // OpenAI Description (using our 800px thumbnail)
+    start := time.Now()
+    openaiDescription, err := GetOpenAIDescription(cfg, thumbPath)
+    if err != nil {
+        logger.Warn("OpenAI description failed", "error", err, "duration", time.Since(start).Round(time.Millisecond))
+        openaiDescription = ""
     } else {
-        log.Printf("Successfully sent image %s to Matrix/Mastodon/ntfy and marked as sent", img.ID)
+        logger.Debug("OpenAI description received", "duration", time.Since(start).Round(time.Millisecond))
     }
+
+    return &preparedImage{
+        Image:       img,
+        ImagePath:   imagePath,
+        ThumbPath:   thumbPath,
+        Description: openaiDescription,
+    }, nil
+}
+
+// Cleanup removes the temp files created by prepareImage.
+func (p *preparedImage) Cleanup() {
+    os.Remove(p.ImagePath)
+    os.Remove(p.ThumbPath)
 }
@@ -10,231 +10,402 @@ import (
         _ "image/png"
         "io"
         "io/ioutil"
-        "log"
+        "log/slog"
         "net/http"
+        "os"
         "path"
         "strings"
+        "sync"
+        "text/template"
         "time"
         "errors"
 
         "github.com/buckket/go-blurhash"
         "maunium.net/go/mautrix"
+        "maunium.net/go/mautrix/appservice"
+        "maunium.net/go/mautrix/crypto/cryptohelper"
         "maunium.net/go/mautrix/event"
         "maunium.net/go/mautrix/id"
 )
 
 type MatrixBot struct {
         client    *mautrix.Client
-        roomID    id.RoomID
+        rooms     []*matrixRoom
+        autoJoin  bool
         tokenFile string
+        crypto    *cryptohelper.CryptoHelper // nil unless matrix.encryption is enabled
+        syncReady chan struct{}              // closed after the first successful /sync
+        encryptionMu sync.Mutex
+        encryption   map[id.RoomID]roomEncryption // Cached isRoomEncrypted answers
+        mediaLimit matrixMediaLimit
+
+        // Appservice mode only: messages are sent by a virtual user per feed
+        as          *appservice.AppService
+        feedMu      sync.Mutex
+        feedIntents map[string]*appservice.IntentAPI
+        processor   *appservice.EventProcessor
+
+        mu        sync.RWMutex // Guards cfg and rooms, which are swapped on config reload
+        cfg       *Config
+        db        *Database
+        started   time.Time // commands sent before this are ignored
+        ctx       context.Context // Cancelled by Close
+        cancel    context.CancelFunc
+}
+
+// matrixRoom is a joined room together with its posting settings.
+type matrixRoom struct {
+        id      id.RoomID
+        cfg     MatrixRoomConfig
+        caption     *template.Template
+        captionHTML *template.Template // nil sends the plain caption only
+}
+
+// NewMatrixBot logs in with the stored credentials (refreshing or logging in
+// again when they are no longer valid) and sets up the configured rooms.
+func NewMatrixBot(cfg *Config, db *Database) (*MatrixBot, error) {
+        ctx := context.Background()
+        session, err := newMatrixSession(ctx, cfg)
+        if err != nil {
+                return nil, err
+        }
+        bot, err := newMatrixBotWithClient(ctx, cfg, db, session.client)
+        if err != nil {
+                return nil, err
+        }
+        go session.keepFresh(bot.ctx)
+        return bot, nil
+}
+
+// newMatrixBotWithClient sets up the configured rooms for a logged-in client
+// and starts syncing if auto_join, encryption or chat commands need it.
+func newMatrixBotWithClient(ctx context.Context, cfg *Config, db *Database, client *mautrix.Client) (*MatrixBot, error) {
+        bot := &MatrixBot{
+                client:    client,
+                autoJoin:  cfg.Matrix.AutoJoin,
+                tokenFile: cfg.Matrix.TokenFile,
+                syncReady: make(chan struct{}),
+                cfg:       cfg,
+                db:        db,
+                started:   time.Now(),
+        }
+        bot.ctx, bot.cancel = context.WithCancel(context.Background())
+        rooms, err := bot.setupRooms(ctx, cfg)
+        if err != nil {
+                return nil, err
+        }
+        bot.rooms = rooms
+        if cfg.Matrix.Encryption.Enabled {
+                if err := bot.setupCrypto(ctx, cfg); err != nil {
+                        return nil, fmt.Errorf("matrix encryption: %w", err)
+                }
+        }
+        if bot.autoJoin || bot.crypto != nil || cfg.Matrix.Commands.Enabled {
+                bot.startSync()
+        }
+        return bot, nil
 }
 
-func NewMatrixBot(cfg *Config) (*MatrixBot, error) {
-        var token string
-        token, err := loadToken(cfg.Matrix.TokenFile)
-        var client *mautrix.Client
-        if err != nil || token == "" {
-                client, err = mautrix.NewClient(cfg.Matrix.ServerURL, "", "")
+// setupRooms resolves, joins and prepares every room configured in cfg.
+func (m *MatrixBot) setupRooms(ctx context.Context, cfg *Config) ([]*matrixRoom, error) {
+        var rooms []*matrixRoom
+        for _, roomCfg := range cfg.MatrixRooms() {
+                room, err := m.setupRoom(ctx, cfg, roomCfg)
                 if err != nil {
-                        return nil, err
+                        return nil, fmt.Errorf("matrix room %s: %w", roomCfg.Room, err)
                 }
-                resp, err := client.Login(context.Background(), &mautrix.ReqLogin{
-                        Type: "m.login.password",
-                        Identifier: mautrix.UserIdentifier{
-                                Type: "m.id.user",
-                                User: cfg.Matrix.User,
-                        },
-                        Password: cfg.Matrix.Password,
-                })
+                rooms = append(rooms, room)
+        }
+        if len(rooms) == 0 {
+                return nil, errors.New("no matrix rooms configured")
+        }
+        return rooms, nil
+}
+
+// Reload switches to the rooms and captions of a new config, keeping the
+// session. The old rooms stay in use if a new one can't be set up.
+func (m *MatrixBot) Reload(cfg *Config) error {
+        rooms, err := m.setupRooms(m.ctx, cfg)
+        if err != nil {
+                return err
+        }
+        m.mu.Lock()
+        defer m.mu.Unlock()
+        m.cfg, m.rooms = cfg, rooms
+        return nil
+}
+
+// Close stops syncing and token refreshes, or in appservice mode the
+// transaction listener, so the bot can be replaced.
+func (m *MatrixBot) Close() {
+        m.cancel()
+        if m.as != nil {
+                m.processor.Stop()
+                m.as.Stop()
+        }
+        if m.crypto != nil {
+                if err := m.crypto.Close(); err != nil {
+                        slog.Warn("Matrix: Failed to close crypto store", "error", err)
+                }
+        }
+}
+
+// config returns the config the bot is currently running with.
+func (m *MatrixBot) config() *Config {
+        m.mu.RLock()
+        defer m.mu.RUnlock()
+        return m.cfg
+}
+
+// roomList returns the rooms the bot currently posts to.
+func (m *MatrixBot) roomList() []*matrixRoom {
+        m.mu.RLock()
+        defer m.mu.RUnlock()
+        return m.rooms
+}
+
+// setupRoom resolves a room alias to its ID, joins the room and parses its caption template.
+func (m *MatrixBot) setupRoom(ctx context.Context, cfg *Config, roomCfg MatrixRoomConfig) (*matrixRoom, error) {
+        room := &matrixRoom{id: id.RoomID(roomCfg.Room), cfg: roomCfg}
+        if strings.HasPrefix(roomCfg.Room, "#") {
+                resp, err := m.client.ResolveAlias(ctx, id.RoomAlias(roomCfg.Room))
                 if err != nil {
-                        return nil, err
+                        return nil, fmt.Errorf("resolving alias: %w", err)
                 }
-                token = resp.AccessToken
-                saveToken(cfg.Matrix.TokenFile, token)
-                client, err = mautrix.NewClient(cfg.Matrix.ServerURL, id.UserID(cfg.Matrix.User), token)
+                room.id = resp.RoomID
+                slog.Info("Matrix: Resolved room alias", "alias", roomCfg.Room, "room_id", room.id)
+        }
+        room.caption = cfg.Templates.Matrix
+        room.captionHTML = cfg.Templates.MatrixHTML
+        if roomCfg.Caption != "" {
+                tmpl, err := parseTemplate(roomCfg.Room+" caption", roomCfg.Caption, "")
                 if err != nil {
                         return nil, err
                 }
-                bot := &MatrixBot{
-                        client:    client,
-                        roomID:    id.RoomID(cfg.Matrix.RoomID),
-                        tokenFile: cfg.Matrix.TokenFile,
-                }
-                
-                // Validate newly created token
-                ctx := context.Background()
-                whoami, err := client.Whoami(ctx)
+                room.caption = tmpl
+                room.captionHTML = nil
+        }
+        if roomCfg.CaptionHTML != "" {
+                tmpl, err := parseTemplate(roomCfg.Room+" caption_html", roomCfg.CaptionHTML, "")
                 if err != nil {
-                        log.Printf("Matrix: Warning - newly created token validation failed (whoami): %v", err)
-                        log.Printf("Matrix: Bot created but token may be invalid. Room: %s", cfg.Matrix.RoomID)
-                } else {
-                        log.Printf("Matrix: Bot created successfully with new login. User: %s, Room: %s", whoami.UserID, cfg.Matrix.RoomID)
+                        return nil, err
                 }
-                
-                return bot, nil
+                room.captionHTML = tmpl
+        }
+        switch roomCfg.Upload {
+        case "", "original", "thumbnail":
+        default:
+                return nil, fmt.Errorf("unknown upload mode %q (want original or thumbnail)", roomCfg.Upload)
         }
+        // Joining a room we are already in is a no-op, so this is safe on every start
+        if _, err := m.client.JoinRoomByID(ctx, room.id); err != nil {
+                slog.Warn("Matrix: Could not join room", "room", roomCfg.Room, "room_id", room.id, "error", err)
+        }
+        return room, nil
+}
 
-        client, err = mautrix.NewClient(cfg.Matrix.ServerURL, id.UserID(cfg.Matrix.User), token)
-        if err != nil {
-                return nil, err
+// startSync runs a background /sync loop. It joins rooms the bot is invited to
+// when auto_join is set, answers chat commands when they are enabled and keeps
+// the crypto store's device and member lists current.
+func (m *MatrixBot) startSync() {
+        syncer, ok := m.client.Syncer.(mautrix.ExtensibleSyncer)
+        if !ok {
+                slog.Warn("Matrix: Syncer does not support event handlers, sync disabled")
+                return
         }
-        
-        // Validate token by calling Whoami
-        ctx := context.Background()
-        whoami, err := client.Whoami(ctx)
-        if err != nil {
-                // Check if it's an invalid token error (401/M_UNKNOWN_TOKEN)
-                var httpErr *mautrix.HTTPError
-                if errors.As(err, &httpErr) && httpErr.Response != nil && httpErr.Response.StatusCode == 401 {
-                        log.Printf("Matrix: Token validation failed (401/M_UNKNOWN_TOKEN), re-authenticating...")
-                        
-                        // Re-authenticate to get a new token
-                        tempClient, err := mautrix.NewClient(cfg.Matrix.ServerURL, "", "")
-                        if err != nil {
-                                return nil, fmt.Errorf("failed to create client for re-auth: %w", err)
-                        }
-                        
-                        resp, err := tempClient.Login(ctx, &mautrix.ReqLogin{
-                                Type: "m.login.password",
-                                Identifier: mautrix.UserIdentifier{
-                                        Type: "m.id.user",
-                                        User: cfg.Matrix.User,
-                                },
-                                Password: cfg.Matrix.Password,
-                        })
-                        if err != nil {
-                                return nil, fmt.Errorf("re-authentication failed: %w", err)
-                        }
-                        
-                        // Save the new token
-                        token = resp.AccessToken
-                        if err := saveToken(cfg.Matrix.TokenFile, token); err != nil {
-                                log.Printf("Matrix: Warning - failed to save new token: %v", err)
-                        } else {
-                                log.Printf("Matrix: New token saved to %s", cfg.Matrix.TokenFile)
-                        }
-                        
-                        // Create client with new token
-                        client, err = mautrix.NewClient(cfg.Matrix.ServerURL, id.UserID(cfg.Matrix.User), token)
-                        if err != nil {
-                                return nil, fmt.Errorf("failed to create client with new token: %w", err)
+        var readyOnce sync.Once
+        syncer.OnSync(func(ctx context.Context, resp *mautrix.RespSync, since string) bool {
+                readyOnce.Do(func() { close(m.syncReady) })
+                return true
+        })
+        syncer.OnEventType(event.StateEncryption, m.handleEncryption)
+        if m.autoJoin {
+                syncer.OnEventType(event.StateMember, m.handleInvite)
+        }
+        if m.cfg.Matrix.Commands.Enabled {
+                syncer.OnEventType(event.EventMessage, m.handleMessage)
+        }
+        go func() {
+                for {
+                        err := m.client.SyncWithContext(m.ctx)
+                        if m.ctx.Err() != nil {
+                                return
                         }
-                        
-                        // Validate the new token
-                        whoami, err = client.Whoami(ctx)
                         if err != nil {
-                                log.Printf("Matrix: Warning - new token validation failed: %v", err)
-                        } else {
-                                log.Printf("Matrix: Re-authenticated successfully. User: %s, Room: %s", whoami.UserID, cfg.Matrix.RoomID)
+                                slog.Error("Matrix: Sync stopped", "error", err)
                         }
-                } else {
-                        log.Printf("Matrix: Warning - token validation failed (whoami): %v", err)
-                        log.Printf("Matrix: Bot created but token may be invalid. Room: %s", cfg.Matrix.RoomID)
+                        slog.Info("Matrix: Restarting sync in 30 seconds")
+                        time.Sleep(30 * time.Second)
                 }
-        } else {
-                log.Printf("Matrix: Bot created successfully. User: %s, Room: %s", whoami.UserID, cfg.Matrix.RoomID)
+        }()
+}
+
+// handleInvite joins rooms the bot user is invited to.
+func (m *MatrixBot) handleInvite(ctx context.Context, evt *event.Event) {
+        if evt.GetStateKey() != m.client.UserID.String() || evt.Content.AsMember().Membership != event.MembershipInvite {
+                return
         }
-        
-        bot := &MatrixBot{
-                client:    client,
-                roomID:    id.RoomID(cfg.Matrix.RoomID),
-                tokenFile: cfg.Matrix.TokenFile,
+        slog.Info("Matrix: Invited to room, joining", "room_id", evt.RoomID, "sender", evt.Sender)
+        if _, err := m.client.JoinRoomByID(ctx, evt.RoomID); err != nil {
+                slog.Error("Matrix: Failed to join room", "room_id", evt.RoomID, "error", err)
         }
-        
-        return bot, nil
 }
 
-func loadToken(filename string) (string, error) {
-        data, err := ioutil.ReadFile(filename)
-        if err != nil {
-                return "", err
+// wants reports whether the room should receive an image from the given feed.
+func (r *matrixRoom) wants(img WallhavenImage, feed string) bool {
+        if len(r.cfg.Feeds) > 0 && !containsString(r.cfg.Feeds, feed) {
+                return false
         }
-        return string(data), nil
+        return r.allowsPurity(img)
 }
 
-func saveToken(filename, token string) error {
-        return ioutil.WriteFile(filename, []byte(token), 0600)
+// allowsPurity reports whether the room's purity filter lets the image through.
+func (r *matrixRoom) allowsPurity(img WallhavenImage) bool {
+        return len(r.cfg.Purity) == 0 || containsString(r.cfg.Purity, img.Purity)
 }
 
-func (m *MatrixBot) SendImage(img WallhavenImage, cfg *Config, openaiDescription string, imagePath, thumbPath string) error {
+// buildCaption renders the room's caption template.
+func (r *matrixRoom) buildCaption(img WallhavenImage, openaiDescription, feed string) (string, error) {
+        return renderTemplate(r.caption, img, openaiDescription, feed)
+}
+
+// buildCaptionHTML renders the room's HTML caption template, or returns "" if
+// the room only has a plain-text caption.
+func (r *matrixRoom) buildCaptionHTML(img WallhavenImage, openaiDescription, feed string) (string, error) {
+        if r.captionHTML == nil {
+                return "", nil
+        }
+        return renderTemplate(r.captionHTML, img, openaiDescription, feed)
+}
+
+// errNoMatrixTarget is returned by SendImage when no room wants the image,
+// which is neither a successful publish nor a failure.
+var errNoMatrixTarget = errors.New("no Matrix room wants the image")
+
+// SendImage posts the image to every configured room whose filters match the
+// feed and purity.
+func (m *MatrixBot) SendImage(img WallhavenImage, cfg *Config, feed, openaiDescription string, imagePath, thumbPath string) error {
+        var targets []*matrixRoom
+        for _, room := range m.roomList() {
+                if room.wants(img, feed) {
+                        targets = append(targets, room)
+                }
+        }
+        if len(targets) == 0 {
+                slog.Info("Matrix: No room wants image", "image_id", img.ID, "feed", feed, "purity", img.Purity)
+                return errNoMatrixTarget
+        }
+        return m.sendImageToRooms(img, cfg, feed, openaiDescription, imagePath, thumbPath, targets)
+}
+
+// sendImageToRooms posts the image to the given rooms. Uploads are shared
+// between rooms; encrypted rooms get encrypted attachments uploaded from the
+// local files.
+func (m *MatrixBot) sendImageToRooms(img WallhavenImage, cfg *Config, feed, openaiDescription string, imagePath, thumbPath string, targets []*matrixRoom) error {
         ctx := context.Background()
 
-        log.Printf("Matrix: Starting to send image %s to room %s", img.ID, m.roomID)
+        encrypted := map[id.RoomID]bool{}
+        var needPlainOriginal, needEncOriginal, needPlainThumb, needEncThumb bool
+        for _, room := range targets {
+                original := room.cfg.Upload != "thumbnail"
+                isEncrypted, err := m.isRoomEncrypted(ctx, room.id)
+                if err != nil {
+                        return err
+                }
+                if isEncrypted {
+                        encrypted[room.id] = true
+                        needEncThumb = true
+                        needEncOriginal = needEncOriginal || original
+                } else {
+                        needPlainThumb = true
+                        needPlainOriginal = needPlainOriginal || original
+                }
+        }
+
+        logger := slog.With("image_id", img.ID, "feed", feed, "destination", "matrix")
+        logger.Debug("Matrix: Sending image", "rooms", len(targets))
         filename := path.Base(img.Path)
+        mainPath, mainMime := imagePath, img.FileType
+
+        // Fall back to a smaller variant if the original exceeds the homeserver's upload limit
+        if needPlainOriginal || needEncOriginal {
+                variant, err := m.fitUploadLimit(ctx, imagePath)
+                if err != nil {
+                        return fmt.Errorf("cannot send original image: %w", err)
+                }
+                if variant != imagePath {
+                        defer os.Remove(variant)
+                        mainPath, mainMime = variant, "image/jpeg"
+                        filename = strings.TrimSuffix(filename, path.Ext(filename)) + ".jpg"
+                }
+        }
 
         // Load main image from local file (already downloaded by main)
-        mainImgData, err := ioutil.ReadFile(imagePath)
+        mainImgData, err := ioutil.ReadFile(mainPath)
         if err != nil {
-                log.Printf("Error reading main image from %s: %v", imagePath, err)
-                return err
+                return fmt.Errorf("reading image: %w", err)
         }
         mainImg, _, err := image.Decode(bytes.NewReader(mainImgData))
         if err != nil {
-                log.Printf("Error decoding main image: %v", err)
-                return err
+                return fmt.Errorf("decoding image: %w", err)
         }
 
         // Load our custom thumbnail (800px max dimension) from local file
         thumbImgData, err := ioutil.ReadFile(thumbPath)
         if err != nil {
-                log.Printf("Error reading thumbnail from %s: %v", thumbPath, err)
-                return err
+                return fmt.Errorf("reading thumbnail: %w", err)
         }
         thumbImg, _, err := image.Decode(bytes.NewReader(thumbImgData))
         if err != nil {
-                log.Printf("Error decoding thumbnail: %v", err)
-                return err
+                return fmt.Errorf("decoding thumbnail: %w", err)
         }
 
-        // Log what will be sent
-        caption := buildCaption(img, openaiDescription)
-        log.Printf("Sending image to Matrix:\n%s\n", caption)
-
-        // Upload original image
-        log.Printf("Matrix: Attempting to upload original image from %s", img.Path)
-        mainResp, err := m.client.UploadLink(ctx, img.Path)
-        if err != nil {
-            log.Printf("Matrix image upload error type: %T", err)
-                var httpErr *mautrix.HTTPError
-                if errors.As(err, &httpErr) {
-                    log.Printf("Matrix image upload error: Message=%q", httpErr.Message)
-                    log.Printf("Matrix image upload error: ResponseBody=%q", httpErr.ResponseBody)
-                    log.Printf("Matrix image upload error: RespError=%#v", httpErr.RespError)
-                    log.Printf("Matrix image upload error: WrappedError=%v", httpErr.WrappedError)
-                    if httpErr.Response != nil {
-                        log.Printf("Matrix image upload error: HTTP Status=%d", httpErr.Response.StatusCode)
-                    }
-            } else {
-                log.Printf("Matrix image upload error: %v", err)
-            }
-            log.Printf("Matrix: Returning on UploadLink.")
-            return err
-        }
-        log.Printf("Matrix: Original image uploaded successfully, URI: %s", mainResp.ContentURI)
+        // Upload original image, only if some unencrypted room wants it
+        var mainResp *mautrix.RespMediaUpload
+        if needPlainOriginal {
+                logger.Debug("Matrix: Uploading original image", "path", mainPath)
+                mainResp, err = m.uploadFile(ctx, mainPath, mainMime, filename)
+                if err != nil {
+                        logMatrixHTTPError(logger, "Matrix: Original image upload failed", err)
+                        return err
+                }
+                logger.Debug("Matrix: Original image uploaded", "uri", mainResp.ContentURI)
+        }
 
         // Upload our custom thumbnail (800px max) as bytes
-        log.Printf("Matrix: Uploading custom thumbnail (800px max) from %s", thumbPath)
-        thumbResp, err := m.client.UploadBytes(ctx, thumbImgData, "image/jpeg")
-        if err != nil {
-            if httpErr, ok := err.(*mautrix.HTTPError); ok {
-                log.Printf("Matrix thumbnail upload error: %s - %s", httpErr.Message, httpErr.ResponseBody)
-            } else {
-                log.Printf("Matrix thumbnail upload error: %v", err)
-            }
-            log.Printf("Matrix: Returning on Thumbnail.")
-            return err
+        var thumbResp *mautrix.RespMediaUpload
+        if needPlainThumb {
+                logger.Debug("Matrix: Uploading thumbnail", "path", thumbPath)
+                thumbResp, err = m.uploadFile(ctx, thumbPath, "image/jpeg", img.ID+"-thumb.jpg")
+                if err != nil {
+                        logMatrixHTTPError(logger, "Matrix: Thumbnail upload failed", err)
+                        return err
+                }
+                logger.Debug("Matrix: Thumbnail uploaded", "uri", thumbResp.ContentURI)
+        }
+
+        // Encrypted rooms need their own uploads: the homeserver only ever sees ciphertext
+        var encMain, encThumb *event.EncryptedFileInfo
+        if needEncOriginal {
+                logger.Debug("Matrix: Uploading encrypted original image", "path", mainPath)
+                encMain, err = m.uploadEncrypted(ctx, mainImgData)
+                if err != nil {
+                        return fmt.Errorf("encrypted image upload: %w", err)
+                }
+        }
+        if needEncThumb {
+                logger.Debug("Matrix: Uploading encrypted thumbnail", "path", thumbPath)
+                encThumb, err = m.uploadEncrypted(ctx, thumbImgData)
+                if err != nil {
+                        return fmt.Errorf("encrypted thumbnail upload: %w", err)
+                }
         }
-        log.Printf("Matrix: Thumbnail uploaded successfully, URI: %s", thumbResp.ContentURI)
 
         // Compute blurhash from already decoded thumbnail
         blurhashStr, err := computeBlurhash(thumbImg)
         if err != nil {
                 blurhashStr = ""
-                if cfg.Debug {
-                        log.Printf("Warning: Could not compute blurhash: %v", err)
-                }
-        } else if cfg.Debug {
-                log.Printf("Matrix: blurhash calculated.")
+                logger.Debug("Matrix: Could not compute blurhash", "error", err)
         }
 
         // Get image dimensions from already decoded images
@@ -252,63 +423,145 @@ func (m *MatrixBot) SendImage(img WallhavenImage, cfg *Config, openaiDescription
                 "h":        thumbHeight,
         }
 
-        info := map[string]interface{}{
-                "mimetype":       img.FileType,
-                "size":           img.FileSize,
-                "thumbnail_url":  thumbResp.ContentURI,
-                "thumbnail_info": thumbnailInfo,
-                "xyz.amorgan.blurhash": blurhashStr,
-                "w":              mainWidth,
-                "h":              mainHeight,
-                "is_animated":    isAnimated,
-        }
+        var errs []error
+        for _, room := range targets {
+                // With threading on, the description goes in a reply instead of the caption
+                captionDescription := openaiDescription
+                if room.cfg.ThreadDescription {
+                        captionDescription = ""
+                }
+                caption, err := room.buildCaption(img, captionDescription, feed)
+                if err != nil {
+                        logger.Warn("Matrix: Caption template failed, using default", "room", room.cfg.Room, "error", err)
+                        caption, _ = renderTemplate(fallbackCaption, img, captionDescription, feed)
+                }
+                captionHTML, err := room.buildCaptionHTML(img, captionDescription, feed)
+                if err != nil {
+                        logger.Warn("Matrix: HTML caption template failed, sending plain text only", "room", room.cfg.Room, "error", err)
+                        captionHTML = ""
+                }
+                logger.Debug("Matrix: Caption", "room_id", room.id, "caption", caption)
 
-        content := map[string]interface{}{
-                "msgtype":  "m.image",
-                "filename": filename,
-                "body":     caption,
-                "url":      mainResp.ContentURI,
-                "info":     info,
+                var content map[string]interface{}
+                if room.cfg.Upload == "thumbnail" {
+                        content = map[string]interface{}{
+                                "msgtype":  "m.image",
+                                "filename": img.ID + ".jpg",
+                                "body":     caption,
+                                "info": map[string]interface{}{
+                                        "mimetype":             "image/jpeg",
+                                        "size":                 len(thumbImgData),
+                                        "xyz.amorgan.blurhash": blurhashStr,
+                                        "w":                    thumbWidth,
+                                        "h":                    thumbHeight,
+                                },
+                        }
+                        if encrypted[room.id] {
+                                content["file"] = encThumb
+                        } else {
+                                content["url"] = thumbResp.ContentURI
+                        }
+                } else {
+                        info := map[string]interface{}{
+                                "mimetype":             mainMime,
+                                "size":                 len(mainImgData),
+                                "thumbnail_info":       thumbnailInfo,
+                                "xyz.amorgan.blurhash": blurhashStr,
+                                "w":                    mainWidth,
+                                "h":                    mainHeight,
+                                "is_animated":          isAnimated,
+                        }
+                        content = map[string]interface{}{
+                                "msgtype":  "m.image",
+                                "filename": filename,
+                                "body":     caption,
+                                "info":     info,
+                        }
+                        if encrypted[room.id] {
+                                content["file"] = encMain
+                                info["thumbnail_file"] = encThumb
+                        } else {
+                                content["url"] = mainResp.ContentURI
+                                info["thumbnail_url"] = thumbResp.ContentURI
+                        }
+                }
+
+                if captionHTML != "" {
+                        content["format"] = event.FormatHTML
+                        content["formatted_body"] = captionHTML
+                }
+
+                roomLog := logger.With("room_id", room.id, "encrypted", encrypted[room.id])
+                sender := m.senderFor(ctx, feed, room.id)
+                eventID, err := m.sendContent(ctx, sender, room.id, encrypted[room.id], content)
+                if err != nil {
+                        logMatrixHTTPError(roomLog, "Matrix: Failed to send message", err)
+                        errs = append(errs, fmt.Errorf("room %s: %w", room.cfg.Room, err))
+                        continue
+                }
+                roomLog.Info("Matrix: Image sent", "event_id", eventID)
+
+                desc := strings.TrimSpace(openaiDescription)
+                if room.cfg.ThreadDescription && desc != "" {
+                        if err := m.sendThreadReply(ctx, sender, room.id, encrypted[room.id], eventID, desc); err != nil {
+                                roomLog.Error("Matrix: Failed to post description thread", "error", err)
+                                errs = append(errs, fmt.Errorf("room %s description: %w", room.cfg.Room, err))
+                        }
+                }
         }
+        return errors.Join(errs...)
+}
 
-        log.Printf("Matrix: Sending message to room %s", m.roomID)
-        _, err = m.client.SendMessageEvent(ctx, m.roomID, event.EventMessage, content)
+// sendContent sends an m.room.message event as sender, encrypting it first for
+// encrypted rooms (which only the bot's own client supports).
+func (m *MatrixBot) sendContent(ctx context.Context, sender *mautrix.Client, roomID id.RoomID, encrypted bool, content interface{}) (id.EventID, error) {
+        if encrypted {
+                return m.sendEncrypted(ctx, roomID, content)
+        }
+        resp, err := sender.SendMessageEvent(ctx, roomID, event.EventMessage, content)
         if err != nil {
-            if httpErr, ok := err.(*mautrix.HTTPError); ok {
-                log.Printf("Matrix HTTP error: %s - %s", httpErr.Message, httpErr.ResponseBody)
-            } else {
-                log.Printf("Matrix send error: %v", err)
-            }
-            log.Printf("Matrix: Failed to send message")
-            return err
-        }
-        log.Printf("Matrix: Message sent successfully to room %s", m.roomID)
-        return nil
+                return "", err
+        }
+        return resp.EventID, nil
 }
 
-func buildCaption(img WallhavenImage, openaiDescription string) string {
-        var tags []string
-        for _, tag := range img.Tags {
-                tags = append(tags, tag.Name)
+// sendThreadReply posts text as an m.thread reply to the given event. Clients
+// without thread support see it as a normal reply.
+func (m *MatrixBot) sendThreadReply(ctx context.Context, sender *mautrix.Client, roomID id.RoomID, encrypted bool, parent id.EventID, text string) error {
+        content := map[string]interface{}{
+                "msgtype": "m.text",
+                "body":    text,
+                "m.relates_to": map[string]interface{}{
+                        "rel_type":        "m.thread",
+                        "event_id":        parent,
+                        "is_falling_back": true,
+                        "m.in_reply_to": map[string]interface{}{
+                                "event_id": parent,
+                        },
+                },
         }
-        base := fmt.Sprintf(
-                "Link: %s\nUploader: %s\nResolution: %s\nType: %s\nSize: %s\nTags: %s",
-                img.URL, img.Uploader.Username, img.Resolution, img.FileType, humanFileSize(img.FileSize), strings.Join(tags, ", "),
-        )
+        _, err := m.sendContent(ctx, sender, roomID, encrypted, content)
+        return err
+}
 
-        desc := strings.TrimSpace(openaiDescription)
-        if len(desc) >= 50 {
-                return base + "\nDescription: " + desc
+// logMatrixHTTPError logs err, including the homeserver's response if there was one.
+func logMatrixHTTPError(logger *slog.Logger, msg string, err error) {
+        var httpErr *mautrix.HTTPError
+        if errors.As(err, &httpErr) && httpErr.Response != nil {
+                logger.Error(msg, "error", err, "status", httpErr.Response.StatusCode, "response", httpErr.ResponseBody)
+                return
         }
-        return base
+        logger.Error(msg, "error", err)
 }
 
-
-
 // Downloads and decodes an image from a URL, returning both the raw bytes and decoded image.
 // This allows reuse of the downloaded data for multiple operations.
 func downloadAndDecodeImage(imageURL string) ([]byte, image.Image, error) {
-        resp, err := http.Get(imageURL)
+        req, err := http.NewRequest("GET", imageURL, nil)
+        if err != nil {
+                return nil, nil, err
+        }
+        resp, err := doRequest("download", req, nil)
         if err != nil {
                 return nil, nil, err
         }
@@ -360,10 +613,3 @@ func humanFileSize(bytes int) string {
                 return fmt.Sprintf("%d bytes", bytes)
         }
 }
-
-
-// Add this helper to main.go for wait logging:
-func logWait(waitTime int) {
-        log.Printf("Waiting %d seconds before next run...\n", waitTime)
-        time.Sleep(time.Duration(waitTime) * time.Second)
-}
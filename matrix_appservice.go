@@ -0,0 +1,188 @@
+package main
+
+import (
+        "context"
+        "errors"
+        "fmt"
+        "log/slog"
+        "net"
+        "regexp"
+        "strconv"
+        "strings"
+        "time"
+
+        "maunium.net/go/mautrix"
+        "maunium.net/go/mautrix/appservice"
+        "maunium.net/go/mautrix/event"
+        "maunium.net/go/mautrix/id"
+)
+
+// defaultAppserviceUserPrefix is the localpart prefix of per-feed virtual users.
+const defaultAppserviceUserPrefix = "wallhaven_"
+
+var invalidLocalpartChars = regexp.MustCompile(`[^a-z0-9._=/-]`)
+
+// GenerateAppserviceRegistration writes a registration YAML with fresh tokens
+// for the homeserver to load. The bot reads the same file when it starts.
+func GenerateAppserviceRegistration(cfg *Config) error {
+        asCfg := cfg.Matrix.Appservice
+        if asCfg.Registration == "" || asCfg.URL == "" || asCfg.HomeserverDomain == "" {
+                return errors.New("matrix.appservice.registration, url and homeserver_domain must be set")
+        }
+        reg := appservice.CreateRegistration()
+        reg.ID = asCfg.ID
+        if reg.ID == "" {
+                reg.ID = "wallhaven-daily"
+        }
+        reg.URL = asCfg.URL
+        reg.SenderLocalpart = asCfg.BotLocalpart
+        if reg.SenderLocalpart == "" {
+                reg.SenderLocalpart = "wallhaven"
+        }
+        rateLimited := false
+        reg.RateLimited = &rateLimited
+
+        domain := regexp.QuoteMeta(asCfg.HomeserverDomain)
+        reg.Namespaces.UserIDs.Register(regexp.MustCompile(fmt.Sprintf("@%s.*:%s", regexp.QuoteMeta(asCfg.userPrefix()), domain)), true)
+        for _, user := range asCfg.Feeds {
+                if user.Localpart != "" && !strings.HasPrefix(user.Localpart, asCfg.userPrefix()) {
+                        reg.Namespaces.UserIDs.Register(regexp.MustCompile(fmt.Sprintf("@%s:%s", regexp.QuoteMeta(user.Localpart), domain)), true)
+                }
+        }
+
+        if err := reg.Save(asCfg.Registration); err != nil {
+                return fmt.Errorf("saving registration: %w", err)
+        }
+        slog.Info("Matrix: Appservice registration written; add it to your homeserver's app_service_config_files", "file", asCfg.Registration)
+        return nil
+}
+
+// NewMatrixAppserviceBot starts the bot as an application service: it loads
+// the registration, listens for transactions from the homeserver and sends
+// images as a virtual user per feed.
+func NewMatrixAppserviceBot(cfg *Config, db *Database) (*MatrixBot, error) {
+        asCfg := cfg.Matrix.Appservice
+        if cfg.Matrix.Encryption.Enabled {
+                return nil, errors.New("matrix encryption is not supported in appservice mode")
+        }
+        reg, err := appservice.LoadRegistration(asCfg.Registration)
+        if err != nil {
+                return nil, fmt.Errorf("loading appservice registration: %w", err)
+        }
+        addSecrets(reg.AppToken, reg.ServerToken)
+        host, portStr, err := net.SplitHostPort(asCfg.ListenAddress)
+        if err != nil {
+                return nil, fmt.Errorf("invalid appservice listen_address %q: %w", asCfg.ListenAddress, err)
+        }
+        port, err := strconv.ParseUint(portStr, 10, 16)
+        if err != nil {
+                return nil, fmt.Errorf("invalid appservice port %q: %w", portStr, err)
+        }
+        as, err := appservice.CreateFull(appservice.CreateOpts{
+                Registration:     reg,
+                HomeserverDomain: asCfg.HomeserverDomain,
+                HomeserverURL:    cfg.Matrix.ServerURL,
+                HostConfig: appservice.HostConfig{
+                        Hostname: host,
+                        Port:     uint16(port),
+                },
+        })
+        if err != nil {
+                return nil, fmt.Errorf("creating appservice: %w", err)
+        }
+        as.HTTPClient = httpClient("matrix")
+
+        ctx := context.Background()
+        botIntent := as.BotIntent()
+        if err := botIntent.EnsureRegistered(ctx); err != nil {
+                return nil, fmt.Errorf("registering appservice bot %s: %w", botIntent.UserID, err)
+        }
+
+        bot := &MatrixBot{
+                client:      botIntent.Client,
+                autoJoin:    cfg.Matrix.AutoJoin,
+                syncReady:   make(chan struct{}),
+                cfg:         cfg,
+                db:          db,
+                started:     time.Now(),
+                as:          as,
+                feedIntents: map[string]*appservice.IntentAPI{},
+        }
+        bot.ctx, bot.cancel = context.WithCancel(context.Background())
+        // There is no /sync in appservice mode and nothing to wait for
+        close(bot.syncReady)
+        rooms, err := bot.setupRooms(ctx, cfg)
+        if err != nil {
+                return nil, err
+        }
+        bot.rooms = rooms
+
+        bot.processor = appservice.NewEventProcessor(as)
+        if bot.autoJoin {
+                bot.processor.On(event.StateMember, bot.handleInvite)
+        }
+        if cfg.Matrix.Commands.Enabled {
+                bot.processor.On(event.EventMessage, bot.handleMessage)
+        }
+        go bot.processor.Start(bot.ctx)
+        go as.Start()
+
+        slog.Info("Matrix: Appservice bot listening", "user_id", botIntent.UserID, "addr", asCfg.ListenAddress, "rooms", len(bot.rooms))
+        return bot, nil
+}
+
+// senderFor returns the client that should post images for the feed. In
+// appservice mode that is the feed's virtual user, joined to the room;
+// otherwise, or if setting up the virtual user fails, it is the bot itself.
+func (m *MatrixBot) senderFor(ctx context.Context, feed string, roomID id.RoomID) *mautrix.Client {
+        if m.as == nil {
+                return m.client
+        }
+        intent, err := m.feedIntent(ctx, feed)
+        if err != nil {
+                slog.Warn("Matrix: Sending as bot, virtual user failed", "feed", feed, "error", err)
+                return m.client
+        }
+        if err := intent.EnsureJoined(ctx, roomID, appservice.EnsureJoinedParams{BotOverride: m.client}); err != nil {
+                slog.Warn("Matrix: Sending as bot, virtual user could not join", "user_id", intent.UserID, "room_id", roomID, "error", err)
+                return m.client
+        }
+        return intent.Client
+}
+
+// feedIntent registers the feed's virtual user on first use and applies its
+// configured displayname and avatar.
+func (m *MatrixBot) feedIntent(ctx context.Context, feed string) (*appservice.IntentAPI, error) {
+        m.feedMu.Lock()
+        defer m.feedMu.Unlock()
+        if intent, ok := m.feedIntents[feed]; ok {
+                return intent, nil
+        }
+
+        asCfg := m.config().Matrix.Appservice
+        user := asCfg.Feeds[feed]
+        localpart := user.Localpart
+        if localpart == "" {
+                localpart = asCfg.userPrefix() + invalidLocalpartChars.ReplaceAllString(strings.ToLower(feed), "_")
+        }
+        intent := m.as.Intent(id.NewUserID(localpart, asCfg.HomeserverDomain))
+        if err := intent.EnsureRegistered(ctx); err != nil {
+                return nil, fmt.Errorf("registering %s: %w", intent.UserID, err)
+        }
+        if user.DisplayName != "" {
+                if err := intent.SetDisplayName(ctx, user.DisplayName); err != nil {
+                        slog.Warn("Matrix: Failed to set displayname", "user_id", intent.UserID, "error", err)
+                }
+        }
+        if user.AvatarURL != "" {
+                avatar, err := id.ParseContentURI(user.AvatarURL)
+                if err != nil {
+                        slog.Warn("Matrix: Invalid avatar_url (want mxc://)", "feed", feed, "error", err)
+                } else if err := intent.SetAvatarURL(ctx, avatar); err != nil {
+                        slog.Warn("Matrix: Failed to set avatar", "user_id", intent.UserID, "error", err)
+                }
+        }
+        slog.Info("Matrix: Feed posts as virtual user", "feed", feed, "user_id", intent.UserID)
+        m.feedIntents[feed] = intent
+        return intent, nil
+}
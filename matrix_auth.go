@@ -0,0 +1,331 @@
+package main
+
+import (
+        "bytes"
+        "context"
+        "encoding/json"
+        "errors"
+        "fmt"
+        "io/ioutil"
+        "log/slog"
+        "net/http"
+        "os"
+        "strings"
+        "sync"
+        "time"
+
+        "maunium.net/go/mautrix"
+        "maunium.net/go/mautrix/id"
+)
+
+// deviceDisplayName is shown in other clients' session lists.
+const deviceDisplayName = "wallhaven-daily"
+
+// refreshMargin is how long before expiry the access token is renewed.
+const refreshMargin = time.Minute
+
+// matrixCredentials is what the token file stores. Older token files that hold
+// only a bare access token are read as such and rewritten in this format.
+type matrixCredentials struct {
+        UserID       id.UserID   `json:"user_id"`
+        DeviceID     id.DeviceID `json:"device_id"`
+        AccessToken  string      `json:"access_token"`
+        RefreshToken string      `json:"refresh_token,omitempty"`
+        ExpiresAt    int64       `json:"expires_at,omitempty"` // Unix milliseconds; 0 if the token doesn't expire
+}
+
+func loadCredentials(filename string) (*matrixCredentials, error) {
+        data, err := ioutil.ReadFile(filename)
+        if err != nil {
+                return nil, err
+        }
+        data = bytes.TrimSpace(data)
+        if len(data) > 0 && data[0] != '{' {
+                return &matrixCredentials{AccessToken: string(data)}, nil
+        }
+        var creds matrixCredentials
+        if err := json.Unmarshal(data, &creds); err != nil {
+                return nil, fmt.Errorf("parsing %s: %w", filename, err)
+        }
+        return &creds, nil
+}
+
+func saveCredentials(filename string, creds matrixCredentials) error {
+        data, err := json.MarshalIndent(creds, "", "  ")
+        if err != nil {
+                return err
+        }
+        return ioutil.WriteFile(filename, data, 0600)
+}
+
+// matrixSession owns the client's credentials and keeps them valid. mautrix
+// reads the client's fields without a lock, so they are only set up front;
+// renewed tokens reach requests through sessionTransport.
+type matrixSession struct {
+        cfg    *Config
+        client *mautrix.Client
+
+        mu       sync.Mutex
+        creds    matrixCredentials
+        rejected chan struct{} // Signalled when the homeserver rejects the current token
+}
+
+// sessionTransport puts the session's current access token on every
+// authenticated request and tells the session when it is rejected.
+type sessionTransport struct {
+        session *matrixSession
+        base    http.RoundTripper
+}
+
+func (t *sessionTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+        if req.Header.Get("Authorization") == "" {
+                return t.base.RoundTrip(req)
+        }
+        req = req.Clone(req.Context())
+        // Logging in and refreshing must work while the old token is rejected
+        if strings.HasSuffix(req.URL.Path, "/login") || strings.HasSuffix(req.URL.Path, "/refresh") {
+                req.Header.Del("Authorization")
+                return t.base.RoundTrip(req)
+        }
+        t.session.mu.Lock()
+        token := t.session.creds.AccessToken
+        t.session.mu.Unlock()
+        req.Header.Set("Authorization", "Bearer "+token)
+
+        resp, err := t.base.RoundTrip(req)
+        if err == nil && resp.StatusCode == http.StatusUnauthorized {
+                t.session.reject(token)
+        }
+        return resp, err
+}
+
+// reject asks keepFresh to renew the token, unless it was renewed since the
+// request that failed was sent.
+func (s *matrixSession) reject(token string) {
+        s.mu.Lock()
+        current := s.creds.AccessToken == token
+        s.mu.Unlock()
+        if !current {
+                return
+        }
+        select {
+        case s.rejected <- struct{}{}:
+        default:
+        }
+}
+
+// newMatrixSession restores the stored credentials if they still work, and
+// otherwise refreshes them or logs in again.
+func newMatrixSession(ctx context.Context, cfg *Config) (*matrixSession, error) {
+        client, err := mautrix.NewClient(cfg.Matrix.ServerURL, "", "")
+        if err != nil {
+                return nil, err
+        }
+        s := &matrixSession{cfg: cfg, client: client, rejected: make(chan struct{}, 1)}
+        client.Client = httpClient("matrix")
+        client.Client.Transport = &sessionTransport{session: s, base: client.Client.Transport}
+
+        creds, err := loadCredentials(cfg.Matrix.TokenFile)
+        if err != nil && !os.IsNotExist(err) {
+                slog.Warn("Matrix: Could not read credentials", "error", err)
+        }
+        if creds == nil || creds.AccessToken == "" {
+                if err := s.login(ctx); err != nil {
+                        return nil, err
+                }
+                s.apply()
+                return s, nil
+        }
+
+        s.creds = *creds
+        s.apply()
+        if s.expiresWithin(refreshMargin) {
+                if err := s.refresh(ctx); err != nil {
+                        slog.Warn("Matrix: Token refresh failed", "error", err)
+                }
+                s.apply()
+        }
+
+        // Validate token by calling Whoami
+        whoami, err := client.Whoami(ctx)
+        if err == nil {
+                // Upgrade legacy token files, which lack the user and device ID
+                if s.creds.UserID == "" || s.creds.DeviceID == "" {
+                        s.creds.UserID, s.creds.DeviceID = whoami.UserID, whoami.DeviceID
+                        s.apply()
+                        s.save()
+                }
+                slog.Info("Matrix: Bot created", "user_id", whoami.UserID, "device_id", whoami.DeviceID, "rooms", len(cfg.MatrixRooms()))
+                return s, nil
+        }
+
+        // Check if it's an invalid token error (401/M_UNKNOWN_TOKEN)
+        var httpErr *mautrix.HTTPError
+        if !errors.As(err, &httpErr) || httpErr.Response == nil || httpErr.Response.StatusCode != 401 {
+                slog.Warn("Matrix: Token validation failed (whoami), bot created but token may be invalid", "error", err, "rooms", len(cfg.MatrixRooms()))
+                return s, nil
+        }
+        if s.creds.RefreshToken != "" {
+                slog.Info("Matrix: Token validation failed (401/M_UNKNOWN_TOKEN), refreshing")
+                if err := s.refresh(ctx); err == nil {
+                        s.apply()
+                        return s, nil
+                }
+                slog.Warn("Matrix: Token refresh failed", "error", err)
+        }
+        slog.Info("Matrix: Token validation failed (401/M_UNKNOWN_TOKEN), re-authenticating")
+        if err := s.login(ctx); err != nil {
+                return nil, fmt.Errorf("re-authentication failed: %w", err)
+        }
+        s.apply()
+        return s, nil
+}
+
+// login logs in with the password, or with a login token for SSO-only
+// homeservers, reusing the stored device ID so no new device is created.
+func (s *matrixSession) login(ctx context.Context) error {
+        req := &mautrix.ReqLogin{
+                DeviceID:                 s.creds.DeviceID,
+                InitialDeviceDisplayName: deviceDisplayName,
+                RefreshToken:             true,
+        }
+        switch {
+        case s.cfg.Matrix.Password != "":
+                req.Type = "m.login.password"
+                req.Identifier = mautrix.UserIdentifier{
+                        Type: "m.id.user",
+                        User: s.cfg.Matrix.User,
+                }
+                req.Password = s.cfg.Matrix.Password
+        case s.cfg.Matrix.LoginToken != "":
+                req.Type = "m.login.token"
+                req.Token = s.cfg.Matrix.LoginToken
+        default:
+                return fmt.Errorf("no password or login token configured; for SSO, open %s/_matrix/client/v3/login/sso/redirect?redirectUrl=http://localhost/ and put the loginToken from the redirect into matrix.login_token",
+                        s.cfg.Matrix.ServerURL)
+        }
+
+        resp, err := s.client.Login(ctx, req)
+        if err != nil {
+                return err
+        }
+        s.mu.Lock()
+        s.creds = matrixCredentials{
+                UserID:       resp.UserID,
+                DeviceID:     resp.DeviceID,
+                AccessToken:  resp.AccessToken,
+                RefreshToken: resp.RefreshToken,
+                ExpiresAt:    expiresAt(resp.ExpiresInMS),
+        }
+        s.mu.Unlock()
+        addSecrets(resp.AccessToken, resp.RefreshToken)
+        s.save()
+        slog.Info("Matrix: Logged in", "user_id", resp.UserID, "device_id", resp.DeviceID, "login_type", req.Type, "rooms", len(s.cfg.MatrixRooms()))
+        return nil
+}
+
+// refresh exchanges the refresh token for a new access token.
+func (s *matrixSession) refresh(ctx context.Context) error {
+        s.mu.Lock()
+        refreshToken := s.creds.RefreshToken
+        s.mu.Unlock()
+        if refreshToken == "" {
+                return errors.New("no refresh token")
+        }
+
+        var resp struct {
+                AccessToken  string `json:"access_token"`
+                RefreshToken string `json:"refresh_token"`
+                ExpiresInMS  int64  `json:"expires_in_ms"`
+        }
+        _, err := s.client.MakeRequest(ctx, "POST", s.client.BuildClientURL("v3", "refresh"), map[string]string{"refresh_token": refreshToken}, &resp)
+        if err != nil {
+                return err
+        }
+        s.mu.Lock()
+        s.creds.AccessToken = resp.AccessToken
+        if resp.RefreshToken != "" {
+                s.creds.RefreshToken = resp.RefreshToken
+        }
+        s.creds.ExpiresAt = expiresAt(resp.ExpiresInMS)
+        s.mu.Unlock()
+        addSecrets(resp.AccessToken, resp.RefreshToken)
+        s.save()
+        slog.Info("Matrix: Access token refreshed")
+        return nil
+}
+
+// keepFresh renews the access token shortly before it expires, and at once
+// when the homeserver rejects it (M_UNKNOWN_TOKEN), falling back to a new
+// login if there is no refresh token or it has been revoked. It stops when
+// ctx is cancelled.
+func (s *matrixSession) keepFresh(ctx context.Context) {
+        for {
+                s.mu.Lock()
+                hasRefresh, expires := s.creds.RefreshToken != "", s.creds.ExpiresAt
+                s.mu.Unlock()
+                var expiry <-chan time.Time
+                if hasRefresh && expires != 0 {
+                        wait := time.Until(time.UnixMilli(expires)) - refreshMargin
+                        if wait < 10*time.Second {
+                                wait = 10 * time.Second
+                        }
+                        expiry = time.After(wait)
+                }
+                select {
+                case <-expiry:
+                case <-s.rejected:
+                        slog.Warn("Matrix: Access token was rejected, renewing it")
+                case <-ctx.Done():
+                        return
+                }
+
+                if err := s.refresh(ctx); err != nil {
+                        slog.Warn("Matrix: Token refresh failed, logging in again", "error", err)
+                        if err := s.login(ctx); err != nil {
+                                slog.Error("Matrix: Re-authentication failed, retrying in 1 minute", "error", err)
+                                time.Sleep(time.Minute)
+                        }
+                }
+        }
+}
+
+// apply copies the credentials onto the client. It must only be called
+// before the client is shared; later tokens are added by sessionTransport.
+func (s *matrixSession) apply() {
+        s.mu.Lock()
+        defer s.mu.Unlock()
+        if s.creds.UserID != "" {
+                s.client.UserID = s.creds.UserID
+        } else {
+                s.client.UserID = id.UserID(s.cfg.Matrix.User)
+        }
+        s.client.DeviceID = s.creds.DeviceID
+        s.client.AccessToken = s.creds.AccessToken
+        addSecrets(s.creds.AccessToken, s.creds.RefreshToken)
+}
+
+func (s *matrixSession) save() {
+        s.mu.Lock()
+        creds := s.creds
+        s.mu.Unlock()
+        if err := saveCredentials(s.cfg.Matrix.TokenFile, creds); err != nil {
+                slog.Warn("Matrix: Failed to save credentials", "error", err)
+        } else {
+                slog.Info("Matrix: Credentials saved", "file", s.cfg.Matrix.TokenFile)
+        }
+}
+
+func (s *matrixSession) expiresWithin(d time.Duration) bool {
+        s.mu.Lock()
+        defer s.mu.Unlock()
+        return s.creds.ExpiresAt != 0 && time.Until(time.UnixMilli(s.creds.ExpiresAt)) < d
+}
+
+// expiresAt converts a relative expires_in_ms to an absolute Unix millisecond time.
+func expiresAt(expiresInMS int64) int64 {
+        if expiresInMS <= 0 {
+                return 0
+        }
+        return time.Now().Add(time.Duration(expiresInMS) * time.Millisecond).UnixMilli()
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+        "context"
+        "fmt"
+        "log/slog"
+        "net/url"
+        "strings"
+        "time"
+
+        "maunium.net/go/mautrix/event"
+        "maunium.net/go/mautrix/id"
+)
+
+// commandPrefix starts every chat command, e.g. "!wall random".
+const commandPrefix = "!wall"
+
+// commandFeed is the feed name passed to caption templates for images posted on request.
+const commandFeed = "command"
+
+// maxCommandCandidates bounds how many search results are checked against the blocklist.
+const maxCommandCandidates = 5
+
+const commandHelp = `Commands:
+!wall random - post a random wallpaper
+!wall search <query> - post the best match for a search
+!wall post <id> - post a specific wallpaper
+!wall stats - show bot statistics
+!wall pause / !wall resume - stop or restart scheduled posting
+!wall skip <tag> - never post wallpapers with this tag`
+
+// handleMessage is the sync handler for m.room.message events.
+func (m *MatrixBot) handleMessage(ctx context.Context, evt *event.Event) {
+        if evt.Sender == m.client.UserID || time.UnixMilli(evt.Timestamp).Before(m.started) {
+                return
+        }
+        msg := evt.Content.AsMessage()
+        fields := strings.Fields(msg.Body)
+        if len(fields) == 0 || fields[0] != commandPrefix {
+                return
+        }
+        room := m.roomByID(evt.RoomID)
+        if room == nil {
+                return
+        }
+        if !m.mayCommand(ctx, evt.RoomID, evt.Sender) {
+                slog.Info("Matrix: Ignoring command, sender not allowed", "sender", evt.Sender, "room_id", evt.RoomID)
+                return
+        }
+        slog.Info("Matrix: Command received", "sender", evt.Sender, "room_id", evt.RoomID, "command", msg.Body)
+        // Commands can take a while (downloads, OpenAI), so don't block the sync loop
+        go m.runCommand(room, fields[1:])
+}
+
+func (m *MatrixBot) roomByID(roomID id.RoomID) *matrixRoom {
+        for _, room := range m.roomList() {
+                if room.id == roomID {
+                        return room
+                }
+        }
+        return nil
+}
+
+// mayCommand reports whether the user is on the allowlist or has enough power in the room.
+func (m *MatrixBot) mayCommand(ctx context.Context, roomID id.RoomID, userID id.UserID) bool {
+        cmds := m.config().Matrix.Commands
+        if containsString(cmds.AllowedUsers, userID.String()) {
+                return true
+        }
+        if cmds.MinPowerLevel <= 0 {
+                return false
+        }
+        var pl event.PowerLevelsEventContent
+        if err := m.client.StateEvent(ctx, roomID, event.StatePowerLevels, "", &pl); err != nil {
+                slog.Warn("Matrix: Failed to get power levels", "room_id", roomID, "error", err)
+                return false
+        }
+        return pl.GetUserLevel(userID) >= cmds.MinPowerLevel
+}
+
+func (m *MatrixBot) runCommand(room *matrixRoom, args []string) {
+        ctx := context.Background()
+        if len(args) == 0 {
+                m.sendNotice(ctx, room, commandHelp)
+                return
+        }
+        rest := strings.TrimSpace(strings.Join(args[1:], " "))
+
+        switch args[0] {
+        case "random":
+                params := m.searchParams()
+                params.Set("sorting", "random")
+                m.postFirstMatch(ctx, room, params)
+        case "search":
+                if rest == "" {
+                        m.sendNotice(ctx, room, "Usage: !wall search <query>")
+                        return
+                }
+                params := m.searchParams()
+                params.Set("q", rest)
+                params.Set("sorting", "relevance")
+                m.postFirstMatch(ctx, room, params)
+        case "post":
+                if rest == "" {
+                        m.sendNotice(ctx, room, "Usage: !wall post <id>")
+                        return
+                }
+                img, err := FetchWallhavenImage(m.config(), rest)
+                if err != nil {
+                        m.sendNotice(ctx, room, fmt.Sprintf("Could not fetch wallpaper %s: %v", rest, err))
+                        return
+                }
+                m.postOnRequest(ctx, room, img)
+        case "stats":
+                m.sendNotice(ctx, room, m.stats())
+        case "pause", "resume":
+                paused := args[0] == "pause"
+                if err := m.db.SetPaused(paused); err != nil {
+                        m.sendNotice(ctx, room, fmt.Sprintf("Failed to %s: %v", args[0], err))
+                        return
+                }
+                if paused {
+                        m.sendNotice(ctx, room, "Scheduled posting paused.")
+                } else {
+                        m.sendNotice(ctx, room, "Scheduled posting resumed.")
+                }
+        case "skip":
+                if rest == "" {
+                        m.sendNotice(ctx, room, "Usage: !wall skip <tag>")
+                        return
+                }
+                if err := m.db.BlockTag(rest); err != nil {
+                        m.sendNotice(ctx, room, fmt.Sprintf("Failed to block tag %q: %v", rest, err))
+                        return
+                }
+                m.sendNotice(ctx, room, fmt.Sprintf("Wallpapers tagged %q will be skipped.", rest))
+        default:
+                m.sendNotice(ctx, room, commandHelp)
+        }
+}
+
+// searchParams returns the configured category and purity filters for on-demand searches.
+func (m *MatrixBot) searchParams() url.Values {
+        params := url.Values{}
+        cfg := m.config()
+        params.Set("categories", cfg.Wallhaven.Categories)
+        params.Set("purity", cfg.Wallhaven.Purity)
+        return params
+}
+
+// postFirstMatch posts the first search result that the room's purity filter
+// allows and that has no blocklisted tag.
+func (m *MatrixBot) postFirstMatch(ctx context.Context, room *matrixRoom, params url.Values) {
+        results, err := SearchWallhaven(m.config(), params)
+        if err != nil {
+                m.sendNotice(ctx, room, fmt.Sprintf("Search failed: %v", err))
+                return
+        }
+        for i, result := range results {
+                if i >= maxCommandCandidates {
+                        break
+                }
+                if !room.allowsPurity(result) {
+                        continue
+                }
+                img, err := imageDetails(m.config(), m.db, result)
+                if err != nil {
+                        slog.Warn("Matrix: Skipping candidate", "image_id", result.ID, "error", err)
+                        continue
+                }
+                if tag, err := m.db.BlockedTag(img); err != nil || tag != "" {
+                        continue
+                }
+                m.postOnRequest(ctx, room, img)
+                return
+        }
+        m.sendNotice(ctx, room, "No matching wallpaper found.")
+}
+
+// postOnRequest prepares the image and posts it to the room that asked for it.
+// It is not marked as sent, so it can still show up in the scheduled feeds.
+// The room's purity filter and the tag blocklist apply as they do to feeds.
+func (m *MatrixBot) postOnRequest(ctx context.Context, room *matrixRoom, img WallhavenImage) {
+        if !room.allowsPurity(img) {
+                m.sendNotice(ctx, room, fmt.Sprintf("Wallpaper %s is %s, which this room doesn't allow.", img.ID, img.Purity))
+                return
+        }
+        if tag, err := m.db.BlockedTag(img); err != nil {
+                m.sendNotice(ctx, room, fmt.Sprintf("Could not check the tag blocklist: %v", err))
+                return
+        } else if tag != "" {
+                m.sendNotice(ctx, room, fmt.Sprintf("Wallpaper %s is tagged %q, which is blocklisted.", img.ID, tag))
+                return
+        }
+        cfg := m.config()
+        prepared, err := prepareImage(cfg, slog.With("feed", commandFeed, "image_id", img.ID), img)
+        if err != nil {
+                m.sendNotice(ctx, room, fmt.Sprintf("Could not prepare wallpaper %s: %v", img.ID, err))
+                return
+        }
+        defer prepared.Cleanup()
+        err = m.sendImageToRooms(img, cfg, commandFeed, prepared.Description, prepared.ImagePath, prepared.ThumbPath, []*matrixRoom{room})
+        if err != nil {
+                m.sendNotice(ctx, room, fmt.Sprintf("Could not post wallpaper %s: %v", img.ID, err))
+        }
+}
+
+func (m *MatrixBot) stats() string {
+        sent, err := m.db.CountSent()
+        if err != nil {
+                return fmt.Sprintf("Failed to read stats: %v", err)
+        }
+        blocked, err := m.db.BlockedTags()
+        if err != nil {
+                return fmt.Sprintf("Failed to read stats: %v", err)
+        }
+        paused, err := m.db.IsPaused()
+        if err != nil {
+                return fmt.Sprintf("Failed to read stats: %v", err)
+        }
+        favourites, err := m.db.CountFavourites()
+        if err != nil {
+                return fmt.Sprintf("Failed to read stats: %v", err)
+        }
+        queued, err := m.db.CountQueued()
+        if err != nil {
+                return fmt.Sprintf("Failed to read stats: %v", err)
+        }
+        return fmt.Sprintf(
+                "Images sent: %d\nQueued: %d\nFavourites: %d\nBlocked tags: %d %v\nPaused: %t\nRooms: %d\nUptime: %s",
+                sent, queued, favourites, len(blocked), blocked, paused, len(m.roomList()), time.Since(m.started).Round(time.Second),
+        )
+}
+
+// sendNotice replies with an m.notice, encrypting it if the room is encrypted.
+// Error text is echoed into rooms, so secrets are scrubbed first.
+func (m *MatrixBot) sendNotice(ctx context.Context, room *matrixRoom, text string) {
+        content := &event.MessageEventContent{MsgType: event.MsgNotice, Body: redact(text)}
+        encrypted, err := m.isRoomEncrypted(ctx, room.id)
+        if err != nil {
+                slog.Error("Matrix: Not sending notice", "room_id", room.id, "error", err)
+                return
+        }
+        if _, err := m.sendContent(ctx, m.client, room.id, encrypted, content); err != nil {
+                slog.Error("Matrix: Failed to send notice", "room_id", room.id, "error", err)
+        }
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+        "context"
+        "errors"
+        "fmt"
+        "log/slog"
+        "os"
+        "time"
+
+        "maunium.net/go/mautrix"
+        "maunium.net/go/mautrix/crypto/attachment"
+        "maunium.net/go/mautrix/crypto/cryptohelper"
+        "maunium.net/go/mautrix/event"
+        "maunium.net/go/mautrix/id"
+)
+
+// defaultPickleKey is used to encrypt the crypto store when no pickle_key is configured.
+const defaultPickleKey = "wallhaven-daily"
+
+// syncReadyTimeout is how long an encrypted send waits for the first /sync,
+// which is needed to know the room members to share keys with.
+const syncReadyTimeout = 2 * time.Minute
+
+// setupCrypto initialises end-to-end encryption with a persistent crypto store
+// and verifies this device through cross-signing if configured to.
+func (m *MatrixBot) setupCrypto(ctx context.Context, cfg *Config) error {
+        enc := cfg.Matrix.Encryption
+        storePath := enc.StorePath
+        if storePath == "" {
+                storePath = cfg.Matrix.TokenFile + ".crypto.db"
+        }
+        pickleKey := enc.PickleKey
+        if pickleKey == "" {
+                slog.Warn("Matrix: No encryption.pickle_key set, using the built-in default")
+                pickleKey = defaultPickleKey
+        }
+
+        if m.client.DeviceID == "" {
+                whoami, err := m.client.Whoami(ctx)
+                if err != nil {
+                        return fmt.Errorf("getting device ID: %w", err)
+                }
+                m.client.DeviceID = whoami.DeviceID
+        }
+
+        helper, err := cryptohelper.NewCryptoHelper(m.client, []byte(pickleKey), storePath)
+        if err != nil {
+                return fmt.Errorf("creating crypto helper: %w", err)
+        }
+        if err := helper.Init(ctx); err != nil {
+                return fmt.Errorf("initialising crypto store %s: %w", storePath, err)
+        }
+        m.client.Crypto = helper
+        m.crypto = helper
+        slog.Info("Matrix: End-to-end encryption enabled", "device_id", m.client.DeviceID, "store", storePath)
+
+        mach := helper.Machine()
+        if enc.RecoveryKey != "" {
+                if err := mach.VerifyWithRecoveryKey(ctx, enc.RecoveryKey); err != nil {
+                        return fmt.Errorf("verifying device with recovery key: %w", err)
+                }
+                slog.Info("Matrix: Device verified with recovery key", "device_id", m.client.DeviceID)
+                return nil
+        }
+        if !enc.BootstrapCrossSigning {
+                slog.Warn("Matrix: Device is not cross-signed; set encryption.recovery_key to verify it", "device_id", m.client.DeviceID)
+                return nil
+        }
+
+        existing := mach.GetOwnCrossSigningPublicKeys(ctx)
+        if existing != nil {
+                slog.Warn("Matrix: Cross-signing keys already exist; set encryption.recovery_key to verify this device", "user_id", m.client.UserID)
+                return nil
+        }
+        recoveryKey, _, err := mach.GenerateAndUploadCrossSigningKeys(ctx, func(uiResp *mautrix.RespUserInteractive) interface{} {
+                return &mautrix.ReqUIAuthLogin{
+                        BaseAuthData: mautrix.BaseAuthData{
+                                Type:    mautrix.AuthTypePassword,
+                                Session: uiResp.Session,
+                        },
+                        User:     m.client.UserID.String(),
+                        Password: cfg.Matrix.Password,
+                }
+        }, enc.Passphrase)
+        if err != nil {
+                return fmt.Errorf("bootstrapping cross-signing: %w", err)
+        }
+        if err := mach.SignOwnMasterKey(ctx); err != nil {
+                return fmt.Errorf("signing own master key: %w", err)
+        }
+        if err := mach.SignOwnDevice(ctx, mach.OwnIdentity()); err != nil {
+                return fmt.Errorf("signing own device: %w", err)
+        }
+        // The key never goes to the logs, which may be shipped elsewhere
+        addSecrets(recoveryKey)
+        keyFile := cfg.Matrix.TokenFile + ".recovery-key"
+        if err := os.WriteFile(keyFile, []byte(recoveryKey+"\n"), 0600); err != nil {
+                return fmt.Errorf("saving recovery key: %w", err)
+        }
+        slog.Warn("Matrix: Cross-signing bootstrapped. Move the recovery key to encryption.recovery_key (or recovery_key_file) and delete the file", "file", keyFile)
+        return nil
+}
+
+// encryptionRecheck is how long a room is trusted to still be unencrypted.
+// Encryption can't be turned off again, so encrypted rooms are never rechecked.
+const encryptionRecheck = 10 * time.Minute
+
+// roomEncryption is a cached isRoomEncrypted answer.
+type roomEncryption struct {
+        encrypted bool
+        checked   time.Time
+}
+
+// isRoomEncrypted asks the homeserver whether encryption is enabled in the
+// room, caching the answer. Only a missing m.room.encryption event means the
+// room is unencrypted; any other error is returned so nothing is sent in
+// plaintext by mistake.
+func (m *MatrixBot) isRoomEncrypted(ctx context.Context, roomID id.RoomID) (bool, error) {
+        m.encryptionMu.Lock()
+        cached, ok := m.encryption[roomID]
+        m.encryptionMu.Unlock()
+        if ok && (cached.encrypted || time.Since(cached.checked) < encryptionRecheck) {
+                return cached.encrypted, nil
+        }
+
+        var content event.EncryptionEventContent
+        err := m.client.StateEvent(ctx, roomID, event.StateEncryption, "", &content)
+        if err != nil && !errors.Is(err, mautrix.MNotFound) {
+                return false, fmt.Errorf("checking whether %s is encrypted: %w", roomID, err)
+        }
+        encrypted := err == nil && content.Algorithm != ""
+        m.setRoomEncryption(roomID, encrypted)
+        return encrypted, nil
+}
+
+func (m *MatrixBot) setRoomEncryption(roomID id.RoomID, encrypted bool) {
+        m.encryptionMu.Lock()
+        defer m.encryptionMu.Unlock()
+        if m.encryption == nil {
+                m.encryption = map[id.RoomID]roomEncryption{}
+        }
+        m.encryption[roomID] = roomEncryption{encrypted: encrypted, checked: time.Now()}
+}
+
+// handleEncryption marks a room as encrypted as soon as /sync shows it was
+// enabled, without waiting for the cached answer to expire.
+func (m *MatrixBot) handleEncryption(ctx context.Context, evt *event.Event) {
+        m.setRoomEncryption(evt.RoomID, true)
+}
+
+// uploadEncrypted encrypts data with a fresh attachment key and uploads the ciphertext.
+func (m *MatrixBot) uploadEncrypted(ctx context.Context, data []byte) (*event.EncryptedFileInfo, error) {
+        file := attachment.NewEncryptedFile()
+        ciphertext := make([]byte, len(data))
+        copy(ciphertext, data)
+        file.EncryptInPlace(ciphertext)
+        resp, err := m.client.UploadBytes(ctx, ciphertext, "application/octet-stream")
+        if err != nil {
+                return nil, err
+        }
+        return &event.EncryptedFileInfo{
+                EncryptedFile: *file,
+                URL:           resp.ContentURI.CUString(),
+        }, nil
+}
+
+// sendEncrypted encrypts content for the room with Megolm and sends it as m.room.encrypted.
+func (m *MatrixBot) sendEncrypted(ctx context.Context, roomID id.RoomID, content interface{}) (id.EventID, error) {
+        if m.crypto == nil {
+                return "", errors.New("room is encrypted but matrix.encryption is not enabled")
+        }
+        select {
+        case <-m.syncReady:
+        case <-time.After(syncReadyTimeout):
+                return "", errors.New("timed out waiting for initial sync")
+        }
+        encrypted, err := m.crypto.Encrypt(ctx, roomID, event.EventMessage, content)
+        if err != nil {
+                return "", fmt.Errorf("encrypting event: %w", err)
+        }
+        resp, err := m.client.SendMessageEvent(ctx, roomID, event.EventEncrypted, encrypted)
+        if err != nil {
+                return "", err
+        }
+        return resp.EventID, nil
+}
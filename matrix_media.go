@@ -0,0 +1,83 @@
+package main
+
+import (
+        "context"
+        "fmt"
+        "log/slog"
+        "os"
+        "sync"
+        "time"
+
+        "maunium.net/go/mautrix"
+)
+
+// mediaConfigRetry is how long after a failed /media/v3/config request the
+// upload limit is assumed unknown before asking again.
+const mediaConfigRetry = 10 * time.Minute
+
+// matrixMediaLimit caches the homeserver's m.upload.size once it is known.
+type matrixMediaLimit struct {
+        mu       sync.Mutex
+        known    bool
+        bytes    int64     // 0 if the homeserver doesn't advertise a limit
+        failedAt time.Time // Last failed request, while the limit isn't known
+}
+
+// uploadLimit returns the homeserver's maximum upload size in bytes, asking
+// /_matrix/media/v3/config until it answers. 0 means unknown or unlimited.
+func (m *MatrixBot) uploadLimit(ctx context.Context) int64 {
+        m.mediaLimit.mu.Lock()
+        defer m.mediaLimit.mu.Unlock()
+        if m.mediaLimit.known || time.Since(m.mediaLimit.failedAt) < mediaConfigRetry {
+                return m.mediaLimit.bytes
+        }
+        var resp struct {
+                UploadSize int64 `json:"m.upload.size"`
+        }
+        _, err := m.client.MakeRequest(ctx, "GET", m.client.BuildURL(mautrix.MediaURLPath{"v3", "config"}), nil, &resp)
+        if err != nil {
+                slog.Warn("Matrix: Could not get media config, assuming no upload limit for now", "error", err, "retry_in", mediaConfigRetry)
+                m.mediaLimit.failedAt = time.Now()
+                return 0
+        }
+        m.mediaLimit.known, m.mediaLimit.bytes = true, resp.UploadSize
+        slog.Info("Matrix: Homeserver upload limit", "limit", humanFileSize(int(resp.UploadSize)))
+        return resp.UploadSize
+}
+
+// fitUploadLimit returns imagePath if it is within the homeserver's upload
+// limit, otherwise a recompressed and, if that isn't enough, progressively
+// downscaled JPEG variant that the caller must remove.
+func (m *MatrixBot) fitUploadLimit(ctx context.Context, imagePath string) (string, error) {
+        limit := m.uploadLimit(ctx)
+        if limit <= 0 {
+                return imagePath, nil
+        }
+        variant, err := ShrinkImageFile(imagePath, limit, "matrix-img")
+        if err != nil {
+                return "", fmt.Errorf("image does not fit the %s upload limit: %w", humanFileSize(int(limit)), err)
+        }
+        if variant != imagePath {
+                slog.Info("Matrix: Image is over the upload limit, sending a smaller variant", "path", imagePath, "limit", humanFileSize(int(limit)))
+        }
+        return variant, nil
+}
+
+// uploadFile streams a local file to the homeserver's media repository.
+func (m *MatrixBot) uploadFile(ctx context.Context, filePath, contentType, fileName string) (*mautrix.RespMediaUpload, error) {
+        file, err := os.Open(filePath)
+        if err != nil {
+                return nil, err
+        }
+        defer file.Close()
+        stat, err := file.Stat()
+        if err != nil {
+                return nil, err
+        }
+        return m.client.UploadMedia(ctx, mautrix.ReqUploadMedia{
+                Content:       file,
+                ContentLength: stat.Size(),
+                ContentType:   contentType,
+                FileName:      fileName,
+        })
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+    "log/slog"
+    "net/http"
+    "strconv"
+    "time"
+
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/client_golang/prometheus/promauto"
+    "github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "wallhaven_daily"
+
+var (
+    wallhavenRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+        Namespace: metricsNamespace,
+        Name:      "wallhaven_requests_total",
+        Help:      "Wallhaven API requests by endpoint (search, image) and HTTP status; status is \"error\" if no response was received.",
+    }, []string{"endpoint", "status"})
+    wallhavenRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+        Namespace: metricsNamespace,
+        Name:      "wallhaven_request_duration_seconds",
+        Help:      "Duration of Wallhaven API requests, including retries.",
+        Buckets:   prometheus.DefBuckets,
+    }, []string{"endpoint"})
+    wallhavenRateLimitRemaining = promauto.NewGauge(prometheus.GaugeOpts{
+        Namespace: metricsNamespace,
+        Name:      "wallhaven_ratelimit_remaining",
+        Help:      "X-Ratelimit-Remaining of the last Wallhaven API response.",
+    })
+    wallhavenRateLimit = promauto.NewGauge(prometheus.GaugeOpts{
+        Namespace: metricsNamespace,
+        Name:      "wallhaven_ratelimit_limit",
+        Help:      "X-Ratelimit-Limit of the last Wallhaven API response.",
+    })
+    wallhavenCacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+        Namespace: metricsNamespace,
+        Name:      "wallhaven_cache_requests_total",
+        Help:      "Cacheable Wallhaven API requests by endpoint (search, image) and result (hit, miss, revalidated).",
+    }, []string{"endpoint", "result"})
+
+    imagesFetched = promauto.NewCounterVec(prometheus.CounterOpts{
+        Namespace: metricsNamespace,
+        Name:      "images_fetched_total",
+        Help:      "New images found by searches, per feed.",
+    }, []string{"feed"})
+    imagesFiltered = promauto.NewCounterVec(prometheus.CounterOpts{
+        Namespace: metricsNamespace,
+        Name:      "images_filtered_total",
+        Help:      "Images not posted, by reason (blocked_tag, prepare_failed, fetch_failed, release_failed).",
+    }, []string{"reason"})
+    imagesSent = promauto.NewCounterVec(prometheus.CounterOpts{
+        Namespace: metricsNamespace,
+        Name:      "images_sent_total",
+        Help:      "Images published, per destination.",
+    }, []string{"destination"})
+    publishFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+        Namespace: metricsNamespace,
+        Name:      "publish_failures_total",
+        Help:      "Failed publishes, per destination.",
+    }, []string{"destination"})
+    publishDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+        Namespace: metricsNamespace,
+        Name:      "publish_duration_seconds",
+        Help:      "Time taken to publish an image, per destination.",
+        Buckets:   prometheus.ExponentialBuckets(0.25, 2, 10),
+    }, []string{"destination"})
+
+    openaiDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+        Namespace: metricsNamespace,
+        Name:      "openai_request_duration_seconds",
+        Help:      "Duration of OpenAI description requests.",
+        Buckets:   prometheus.ExponentialBuckets(0.5, 2, 8),
+    })
+    openaiTokens = promauto.NewCounterVec(prometheus.CounterOpts{
+        Namespace: metricsNamespace,
+        Name:      "openai_tokens_total",
+        Help:      "OpenAI tokens used, by type (prompt, completion).",
+    }, []string{"type"})
+
+    rateLimitWait = promauto.NewCounter(prometheus.CounterOpts{
+        Namespace: metricsNamespace,
+        Name:      "wallhaven_ratelimit_wait_seconds_total",
+        Help:      "Time spent waiting for the Wallhaven rate limiter, summed over all workers.",
+    })
+    _ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+        Namespace: metricsNamespace,
+        Name:      "wallhaven_ratelimit_tokens",
+        Help:      "Requests the Wallhaven rate limiter would allow right now.",
+    }, func() float64 {
+        tokens, _ := wallhavenLimiter.State()
+        return tokens
+    })
+    _ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+        Namespace: metricsNamespace,
+        Name:      "wallhaven_ratelimit_paused_seconds",
+        Help:      "Seconds left in the current pause after a 429, 0 if not paused.",
+    }, func() float64 {
+        _, until := wallhavenLimiter.State()
+        if d := time.Until(until); d > 0 {
+            return d.Seconds()
+        }
+        return 0
+    })
+
+    downloadBytes = promauto.NewCounter(prometheus.CounterOpts{
+        Namespace: metricsNamespace,
+        Name:      "download_bytes_total",
+        Help:      "Bytes of images downloaded.",
+    })
+)
+
+// registerQueueMetric exposes the number of images waiting in the outbox.
+func registerQueueMetric(db *Database) {
+    promauto.NewGaugeFunc(prometheus.GaugeOpts{
+        Namespace: metricsNamespace,
+        Name:      "outbox_queue_depth",
+        Help:      "Images waiting in the outbox.",
+    }, func() float64 {
+        n, err := db.CountQueued()
+        if err != nil {
+            slog.Error("Metrics: failed to count queued images", "error", err)
+            return 0
+        }
+        return float64(n)
+    })
+}
+
+// MetricsHandler serves the Prometheus metrics.
+func MetricsHandler() http.Handler {
+    return promhttp.Handler()
+}
+
+// observeWallhavenResponse records the status and rate limit headers of one
+// Wallhaven API response; resp is nil if the request failed.
+func observeWallhavenResponse(endpoint string, resp *http.Response) {
+    if resp == nil {
+        wallhavenRequests.WithLabelValues(endpoint, "error").Inc()
+        return
+    }
+    wallhavenRequests.WithLabelValues(endpoint, strconv.Itoa(resp.StatusCode)).Inc()
+    info := ParseRateLimitHeaders(resp)
+    if info.Limit > 0 {
+        wallhavenRateLimit.Set(float64(info.Limit))
+        wallhavenRateLimitRemaining.Set(float64(info.Remaining))
+    }
+}
+
+// observePublish records the outcome of publishing to one destination.
+func observePublish(destination string, started time.Time, err error) {
+    publishDuration.WithLabelValues(destination).Observe(time.Since(started).Seconds())
+    if err != nil {
+        publishFailures.WithLabelValues(destination).Inc()
+        return
+    }
+    imagesSent.WithLabelValues(destination).Inc()
+    health.published(destination)
+}
@@ -1,49 +1,135 @@
 package main
 
 import (
+    "bytes"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
     "fmt"
     "io"
+    "log/slog"
     "net/http"
     "os"
+    "path"
     "path/filepath"
     "strings"
 )
 
-// BuildNtfyStatus constructs the ntfy notification message.
-// It uses the same pattern as Mastodon, including tags at the end, with an empty line before.
-func BuildNtfyStatus(img WallhavenImage, aiDescription string) string {
-    return fmt.Sprintf(
-        "Description: %s",
-        aiDescription,
-    )
+// ntfyAction is one action button, in the JSON form of the ntfy publish API.
+type ntfyAction struct {
+    Action string `json:"action"`
+    Label  string `json:"label"`
+    URL    string `json:"url"`
+    Method string `json:"method,omitempty"`
+    Clear  bool   `json:"clear,omitempty"`
 }
 
-// SendNtfyImageNotification sends an image file to ntfy with the given message and tags
-func SendNtfyImageNotification(cfg *Config, localImagePath, message string, tags []string, whurl string) error {
-    url := fmt.Sprintf("%s/%s", cfg.Ntfy.Server, cfg.Ntfy.Topic)
-    file, err := os.Open(localImagePath)
+// ntfyPublish is the JSON publish body used in attach mode.
+type ntfyPublish struct {
+    Topic    string       `json:"topic"`
+    Message  string       `json:"message"`
+    Title    string       `json:"title"`
+    Tags     []string     `json:"tags,omitempty"`
+    Priority int          `json:"priority"`
+    Click    string       `json:"click"`
+    Attach   string       `json:"attach,omitempty"`
+    Filename string       `json:"filename,omitempty"`
+    Icon     string       `json:"icon,omitempty"`
+    Actions  []ntfyAction `json:"actions"`
+}
+
+// SendNtfyImageNotification sends an image to ntfy with the given message and tags.
+// Priority, icon and extra tags come from config, with per-feed overrides, and the
+// notification links to the wallpaper page with action buttons. In "attach" mode
+// ntfy fetches the image from Wallhaven itself instead of us uploading it.
+func SendNtfyImageNotification(cfg *Config, img WallhavenImage, feed, localImagePath, thumbPath, message string, tags []string) error {
+    priority, icon, extraTags := ntfyFeedSettings(cfg, feed)
+    tags = append(extraTags, tags...)
+
+    var req *http.Request
+    var err error
+    if cfg.Ntfy.Mode == "attach" {
+        req, err = ntfyAttachRequest(cfg, img, localImagePath, message, priority, icon, tags)
+    } else {
+        var cleanup func()
+        req, cleanup, err = ntfyUploadRequest(cfg, img, localImagePath, thumbPath)
+        if cleanup != nil {
+            defer cleanup()
+        }
+        if err == nil {
+            // The message and tags go in the query, which unlike a header
+            // can carry newlines and non-ASCII text
+            query := req.URL.Query()
+            query.Set("message", message)
+            if len(tags) > 0 {
+                query.Set("tags", strings.Join(tags, ","))
+            }
+            req.URL.RawQuery = query.Encode()
+            req.Header.Set("Priority", priority)
+            req.Header.Set("Title", img.URL)
+            req.Header.Set("Click", img.URL)
+            req.Header.Set("Actions", ntfyActionsHeader(ntfyActions(cfg, img)))
+            if icon != "" {
+                req.Header.Set("Icon", icon)
+            }
+        }
+    }
     if err != nil {
         return err
     }
-    defer file.Close()
+    setNtfyAuth(cfg, req)
 
-    req, err := http.NewRequest("PUT", url, file)
+    resp, err := doRequest("ntfy", req, nil)
     if err != nil {
         return err
     }
+    defer resp.Body.Close()
+    if resp.StatusCode >= 300 {
+        body, _ := io.ReadAll(resp.Body)
+        return fmt.Errorf("ntfy image notification failed: %s - %s", resp.Status, redact(string(body)))
+    }
+    return nil
+}
 
-    // Set required headers
-    req.Header.Set("Filename", filepath.Base(localImagePath))
-    req.Header.Set("Message", message)
-    req.Header.Set("Priority", "low")
-    req.Header.Set("Title", whurl)
-    if len(tags) > 0 {
-        // tags can be comma separated
-        req.Header.Set("Tags", strings.Join(tags, ","))
+// ntfyUploadRequest builds a PUT with the image as the body. Images over the
+// attachment limit are replaced by a recompressed or downscaled copy, or if
+// even 1 megapixel is too big, by our thumbnail. The returned cleanup removes any temp file created.
+func ntfyUploadRequest(cfg *Config, img WallhavenImage, localImagePath, thumbPath string) (*http.Request, func(), error) {
+    uploadPath := localImagePath
+    filename := path.Base(img.Path)
+    var cleanup func()
+    if limit := cfg.Ntfy.attachmentLimit(); limit > 0 {
+        variant, err := ShrinkImageFile(localImagePath, limit, "ntfy-img")
+        switch {
+        case err != nil:
+            slog.Info("ntfy: image is over the attachment limit, sending the thumbnail", "image_id", img.ID, "limit", humanFileSize(int(limit)), "error", err)
+            uploadPath = thumbPath
+        case variant != localImagePath:
+            slog.Info("ntfy: image is over the attachment limit, sending a recompressed or downscaled copy", "image_id", img.ID, "limit", humanFileSize(int(limit)))
+            uploadPath = variant
+            cleanup = func() { os.Remove(variant) }
+        }
+        if uploadPath != localImagePath {
+            filename = strings.TrimSuffix(filename, path.Ext(filename)) + ".jpg"
+        }
+    }
+
+    file, err := os.Open(uploadPath)
+    if err != nil {
+        return nil, cleanup, err
+    }
+    req, err := http.NewRequest("PUT", fmt.Sprintf("%s/%s", cfg.Ntfy.Server, cfg.Ntfy.Topic), file)
+    if err != nil {
+        file.Close()
+        return nil, cleanup, err
     }
+    // Reopen the file if the upload has to be retried
+    req.GetBody = func() (io.ReadCloser, error) { return os.Open(uploadPath) }
+    req.Header.Set("Filename", filename)
 
     // Set Content-Type based on file extension (optional)
-    switch strings.ToLower(filepath.Ext(localImagePath)) {
+    switch strings.ToLower(path.Ext(filename)) {
     case ".jpg", ".jpeg":
         req.Header.Set("Content-Type", "image/jpeg")
     case ".png":
@@ -53,17 +139,188 @@ func SendNtfyImageNotification(cfg *Config, localImagePath, message string, tags
     default:
         req.Header.Set("Content-Type", "application/octet-stream")
     }
+    return req, cleanup, nil
+}
 
-    resp, err := http.DefaultClient.Do(req)
+// ntfyAttachRequest builds a JSON publish that has ntfy attach the image by URL:
+// the original if it is within the attachment limit, else a smaller copy (see
+// ntfyAttachVariant). Without one the notification is sent without attachment.
+func ntfyAttachRequest(cfg *Config, img WallhavenImage, localImagePath, message, priority, icon string, tags []string) (*http.Request, error) {
+    attach := img.Path
+    filename := path.Base(img.Path)
+    if limit := cfg.Ntfy.attachmentLimit(); limit > 0 && int64(img.FileSize) > limit {
+        attach, filename = ntfyAttachVariant(cfg, img, localImagePath, limit)
+    }
+    body, err := json.Marshal(ntfyPublish{
+        Topic:    cfg.Ntfy.Topic,
+        Message:  message,
+        Title:    img.URL,
+        Tags:     tags,
+        Priority: ntfyPriorityNumber(priority),
+        Click:    img.URL,
+        Attach:   attach,
+        Filename: filename,
+        Icon:     icon,
+        Actions:  ntfyActions(cfg, img),
+    })
     if err != nil {
-        return err
+        return nil, err
     }
-    defer resp.Body.Close()
-    if resp.StatusCode >= 300 {
-        body, _ := io.ReadAll(resp.Body)
-        return fmt.Errorf("ntfy image notification failed: %s - %s", resp.Status, string(body))
+    req, err := http.NewRequest("POST", cfg.Ntfy.Server, bytes.NewReader(body))
+    if err != nil {
+        return nil, err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    return req, nil
+}
+
+// ntfyAttachVariant returns the URL and filename of a copy of the image within
+// limit: a recompressed or downscaled copy served from the variants directory
+// if our HTTP server is public, otherwise Wallhaven's thumbnail. Both are empty
+// if there is neither.
+func ntfyAttachVariant(cfg *Config, img WallhavenImage, localImagePath string, limit int64) (attach, filename string) {
+    logger := slog.With("image_id", img.ID, "limit", humanFileSize(int(limit)))
+    if dir := cfg.Webhook.VariantsDir; dir != "" && cfg.HTTP.PublicURL != "" {
+        name, err := publishShrunkVariant(dir, img, localImagePath, limit)
+        if err == nil {
+            logger.Info("ntfy: image is over the attachment limit, attaching a recompressed or downscaled copy")
+            return strings.TrimSuffix(cfg.HTTP.PublicURL, "/") + "/variants/" + name, name
+        }
+        logger.Warn("ntfy: could not publish a copy within the attachment limit", "error", err)
+    }
+    if img.Thumbs.Original != "" {
+        logger.Info("ntfy: image is over the attachment limit, attaching the thumbnail")
+        return img.Thumbs.Original, path.Base(img.Thumbs.Original)
+    }
+    logger.Warn("ntfy: image is over the attachment limit and there is no smaller copy, sending without attachment")
+    return "", ""
+}
+
+// publishShrunkVariant puts a copy of the image within maxBytes in the
+// variants directory and returns its name there.
+func publishShrunkVariant(dir string, img WallhavenImage, localImagePath string, maxBytes int64) (string, error) {
+    variant, err := ShrinkImageFile(localImagePath, maxBytes, "ntfy-img")
+    if err != nil {
+        return "", err
+    }
+    if err := os.MkdirAll(dir, 0755); err != nil {
+        return "", err
+    }
+    name := img.ID + "-ntfy" + filepath.Ext(variant)
+    if variant == localImagePath {
+        return name, copyFile(variant, filepath.Join(dir, name))
+    }
+    return name, moveFile(variant, filepath.Join(dir, name))
+}
+
+// ntfyPriorityNumber converts a priority name to the 1-5 scale the JSON API uses.
+func ntfyPriorityNumber(priority string) int {
+    switch priority {
+    case "min", "1":
+        return 1
+    case "low", "2":
+        return 2
+    case "high", "4":
+        return 4
+    case "urgent", "max", "5":
+        return 5
+    default:
+        return 3
+    }
+}
+
+// setNtfyAuth adds the configured access token or basic auth credentials.
+func setNtfyAuth(cfg *Config, req *http.Request) {
+    switch {
+    case cfg.Ntfy.AccessToken != "":
+        req.Header.Set("Authorization", "Bearer "+cfg.Ntfy.AccessToken)
+    case cfg.Ntfy.Username != "":
+        req.SetBasicAuth(cfg.Ntfy.Username, cfg.Ntfy.Password)
+    }
+}
+
+// ntfyFeedSettings returns the priority, icon and extra tags for a feed,
+// applying its overrides on top of the ntfy defaults.
+func ntfyFeedSettings(cfg *Config, feed string) (priority, icon string, tags []string) {
+    priority, icon = cfg.Ntfy.Priority, cfg.Ntfy.Icon
+    tags = append(tags, cfg.Ntfy.Tags...)
+    if override, ok := cfg.Ntfy.Feeds[feed]; ok {
+        if override.Priority != "" {
+            priority = override.Priority
+        }
+        if override.Icon != "" {
+            icon = override.Icon
+        }
+        tags = append(tags, override.Tags...)
+    }
+    if priority == "" {
+        priority = "low"
+    }
+    return priority, icon, tags
+}
+
+// ntfyActions returns the action buttons: open the wallpaper page, download the
+// original and, if the HTTP server and a secret are configured, favourite it
+// through a callback to the bot.
+func ntfyActions(cfg *Config, img WallhavenImage) []ntfyAction {
+    actions := []ntfyAction{
+        {Action: "view", Label: "Open on Wallhaven", URL: img.URL},
+        {Action: "view", Label: "Download original", URL: img.Path},
+    }
+    if cfg.Ntfy.FavouriteSecret != "" && cfg.HTTP.PublicURL != "" {
+        callback := fmt.Sprintf("%s/ntfy/favourite?id=%s&sig=%s",
+            strings.TrimSuffix(cfg.HTTP.PublicURL, "/"), img.ID, ntfyFavouriteSignature(cfg, img.ID))
+        actions = append(actions, ntfyAction{Action: "http", Label: "Set as favourite", URL: callback, Method: "POST", Clear: true})
+    }
+    return actions
+}
+
+// ntfyActionsHeader formats actions in the short header syntax.
+func ntfyActionsHeader(actions []ntfyAction) string {
+    var parts []string
+    for _, a := range actions {
+        part := fmt.Sprintf("%s, %s, %s", a.Action, a.Label, a.URL)
+        if a.Method != "" {
+            part += ", method=" + a.Method
+        }
+        if a.Clear {
+            part += ", clear=true"
+        }
+        parts = append(parts, part)
+    }
+    return strings.Join(parts, "; ")
+}
+
+// ntfyFavouriteSignature authenticates favourite callbacks so only links we sent work.
+func ntfyFavouriteSignature(cfg *Config, imageID string) string {
+    mac := hmac.New(sha256.New, []byte(cfg.Ntfy.FavouriteSecret))
+    mac.Write([]byte(imageID))
+    return hex.EncodeToString(mac.Sum(nil))
+}
+
+// NtfyFavouriteHandler handles the "Set as favourite" action button.
+func NtfyFavouriteHandler(state *liveState, db *Database) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        cfg := state.config()
+        if r.Method != http.MethodPost {
+            http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+            return
+        }
+        imageID := r.URL.Query().Get("id")
+        sig := r.URL.Query().Get("sig")
+        if imageID == "" || cfg.Ntfy.FavouriteSecret == "" ||
+            !hmac.Equal([]byte(sig), []byte(ntfyFavouriteSignature(cfg, imageID))) {
+            http.Error(w, "forbidden", http.StatusForbidden)
+            return
+        }
+        if err := db.AddFavourite(imageID); err != nil {
+            slog.Error("Failed to favourite image", "image_id", imageID, "error", err)
+            http.Error(w, "internal error", http.StatusInternalServerError)
+            return
+        }
+        slog.Info("Image set as favourite from ntfy", "image_id", imageID)
+        w.WriteHeader(http.StatusNoContent)
     }
-    return nil
 }
 
 // Helper to produce tag hashtags (same as Mastodon/Matrix)
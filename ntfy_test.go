@@ -0,0 +1,148 @@
+package main
+
+import (
+    "encoding/json"
+    "image"
+    "image/color"
+    "image/jpeg"
+    "math/rand"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path"
+    "path/filepath"
+    "reflect"
+    "strings"
+    "testing"
+)
+
+func TestSendNtfyImageNotificationMessage(t *testing.T) {
+    if err := setupHTTPClient(&Config{}); err != nil {
+        t.Fatal(err)
+    }
+    imagePath := filepath.Join(t.TempDir(), "image.jpg")
+    if err := os.WriteFile(imagePath, []byte("jpeg"), 0644); err != nil {
+        t.Fatal(err)
+    }
+    message := "Description: Ein Stück Himmel\nzweite Zeile ✓"
+    tags := []string{"空", "sky"}
+
+    tests := []struct {
+        mode string
+    }{
+        {"upload"},
+        {"attach"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.mode, func(t *testing.T) {
+            var gotMessage string
+            var gotTags []string
+            server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                if r.Header.Get("Content-Type") == "application/json" {
+                    var publish ntfyPublish
+                    if err := json.NewDecoder(r.Body).Decode(&publish); err != nil {
+                        t.Error(err)
+                    }
+                    gotMessage, gotTags = publish.Message, publish.Tags
+                    return
+                }
+                gotMessage = r.URL.Query().Get("message")
+                gotTags = strings.Split(r.URL.Query().Get("tags"), ",")
+            }))
+            defer server.Close()
+
+            cfg := &Config{}
+            cfg.Ntfy.Server, cfg.Ntfy.Topic, cfg.Ntfy.Mode = server.URL, "wallpapers", tt.mode
+            img := testImage(t, "abc123")
+            if err := SendNtfyImageNotification(cfg, img, "1d", imagePath, imagePath, message, tags); err != nil {
+                t.Fatal(err)
+            }
+            if gotMessage != message {
+                t.Errorf("message = %q, want %q", gotMessage, message)
+            }
+            if !reflect.DeepEqual(gotTags, tags) {
+                t.Errorf("tags = %q, want %q", gotTags, tags)
+            }
+        })
+    }
+}
+
+// writeNoiseJPEG writes a JPEG of random pixels, which barely compresses.
+func writeNoiseJPEG(t *testing.T, name string, size int) {
+    t.Helper()
+    img := image.NewRGBA(image.Rect(0, 0, size, size))
+    rng := rand.New(rand.NewSource(1))
+    for y := 0; y < size; y++ {
+        for x := 0; x < size; x++ {
+            img.Set(x, y, color.RGBA{uint8(rng.Intn(256)), uint8(rng.Intn(256)), uint8(rng.Intn(256)), 255})
+        }
+    }
+    file, err := os.Create(name)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer file.Close()
+    if err := jpeg.Encode(file, img, &jpeg.Options{Quality: 100}); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestNtfyAttachRequest(t *testing.T) {
+    dir := t.TempDir()
+    imagePath := filepath.Join(dir, "image.jpg")
+    writeNoiseJPEG(t, imagePath, 1200)
+    info, err := os.Stat(imagePath)
+    if err != nil {
+        t.Fatal(err)
+    }
+    const limitMB = 1
+    if info.Size() <= limitMB<<20 {
+        t.Fatalf("test image is only %d bytes", info.Size())
+    }
+
+    tests := []struct {
+        name       string
+        limitMB    int
+        publicURL  string
+        thumb      string
+        wantAttach string
+    }{
+        {"no limit", 0, "https://bot.example.org", "", "https://w.wallhaven.cc/full/abc123.jpg"},
+        {"downscaled copy", limitMB, "https://bot.example.org/", "https://th.wallhaven.cc/orig/abc123.jpg", "https://bot.example.org/variants/abc123-ntfy.jpg"},
+        {"thumbnail without a public server", limitMB, "", "https://th.wallhaven.cc/orig/abc123.jpg", "https://th.wallhaven.cc/orig/abc123.jpg"},
+        {"nothing small enough", limitMB, "", "", ""},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            cfg := &Config{}
+            cfg.Ntfy.Server, cfg.Ntfy.Topic, cfg.Ntfy.AttachmentLimitMB = "https://ntfy.example.org", "wallpapers", tt.limitMB
+            cfg.HTTP.PublicURL = tt.publicURL
+            cfg.Webhook.VariantsDir = filepath.Join(t.TempDir(), "variants")
+            img := testImage(t, "abc123")
+            img.FileSize = int(info.Size())
+            img.Thumbs.Original = tt.thumb
+
+            req, err := ntfyAttachRequest(cfg, img, imagePath, "message", "low", "", nil)
+            if err != nil {
+                t.Fatal(err)
+            }
+            var publish ntfyPublish
+            if err := json.NewDecoder(req.Body).Decode(&publish); err != nil {
+                t.Fatal(err)
+            }
+            if publish.Attach != tt.wantAttach {
+                t.Errorf("attach = %q, want %q", publish.Attach, tt.wantAttach)
+            }
+            if !strings.HasPrefix(tt.wantAttach, "https://bot.example.org/variants/") {
+                return
+            }
+            variant, err := os.Stat(filepath.Join(cfg.Webhook.VariantsDir, path.Base(tt.wantAttach)))
+            if err != nil {
+                t.Fatal(err)
+            }
+            if variant.Size() > limitMB<<20 {
+                t.Errorf("served copy is %d bytes, over the limit", variant.Size())
+            }
+        })
+    }
+}
@@ -6,9 +6,10 @@ import (
         "encoding/json"
         "fmt"
         "io"
-        "log"
+        "log/slog"
         "net/http"
         "os"
+        "time"
 )
 
 type OpenAIResponse struct {
@@ -17,6 +18,10 @@ type OpenAIResponse struct {
                         Content string `json:"content"`
                 } `json:"message"`
         } `json:"choices"`
+        Usage struct {
+                PromptTokens     int `json:"prompt_tokens"`
+                CompletionTokens int `json:"completion_tokens"`
+        } `json:"usage"`
 }
 
 func GetOpenAIDescription(cfg *Config, imagePath string) (string, error) {
@@ -60,31 +65,35 @@ func GetOpenAIDescription(cfg *Config, imagePath string) (string, error) {
         req.Header.Set("Authorization", "Bearer "+cfg.OpenAIKey)
         req.Header.Set("Content-Type", "application/json")
 
-        resp, err := http.DefaultClient.Do(req)
+        start := time.Now()
+        resp, err := doRequest("openai", req, nil)
         if err != nil {
                 return "", fmt.Errorf("failed to send request to openai: %w", err)
         }
         defer resp.Body.Close()
 
         body, _ := io.ReadAll(resp.Body)
+        openaiDuration.Observe(time.Since(start).Seconds())
 
         if resp.StatusCode != 200 {
-                log.Printf("OpenAI API error status %d: %s", resp.StatusCode, string(body))
-                return "", fmt.Errorf("openai api error: %s", string(body))
+                slog.Debug("OpenAI API error", "status", resp.StatusCode, "body", string(body))
+                return "", fmt.Errorf("openai api error: %s", redact(string(body)))
         }
 
         var openaiResp OpenAIResponse
         if err := json.Unmarshal(body, &openaiResp); err != nil {
-                log.Printf("OpenAI API unmarshal error: %v, body: %s", err, string(body))
+                slog.Debug("OpenAI API unmarshal error", "error", err, "body", string(body))
                 return "", fmt.Errorf("failed to decode openai response: %w", err)
         }
+        openaiTokens.WithLabelValues("prompt").Add(float64(openaiResp.Usage.PromptTokens))
+        openaiTokens.WithLabelValues("completion").Add(float64(openaiResp.Usage.CompletionTokens))
         if len(openaiResp.Choices) == 0 {
-                log.Printf("OpenAI API returned no choices. Body: %s", string(body))
+                slog.Debug("OpenAI API returned no choices", "body", string(body))
                 return "", fmt.Errorf("no description returned from openai")
         }
         desc := openaiResp.Choices[0].Message.Content
         if len(desc) < 50 {
-                log.Printf("OpenAI returned a suspiciously short description: %q", desc)
+                slog.Warn("OpenAI returned a suspiciously short description", "description", desc)
                 // Return a generic description instead of an error
                 return "No detailed description available for this image.", nil
         }
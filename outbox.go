@@ -0,0 +1,289 @@
+package main
+
+import (
+    "fmt"
+    "log/slog"
+    "os"
+    "path/filepath"
+    "time"
+)
+
+const (
+    // outboxPollInterval is the longest the outbox sleeps before looking
+    // again, so pausing, resuming and newly queued images are noticed promptly.
+    outboxPollInterval = time.Minute
+    // outboxRetryDelay is how long an image waits after its first failed
+    // release; the wait doubles with every further failure.
+    outboxRetryDelay = 10 * time.Minute
+    // outboxMaxAttempts is how often an image is tried before it is dropped.
+    outboxMaxAttempts = 5
+)
+
+// outboxSchedule decides when the next queued image may be released.
+type outboxSchedule struct {
+    interval   time.Duration
+    loc        *time.Location
+    start, end time.Duration // Offsets from midnight; equal means no window
+    maxPerDay  int
+}
+
+// OutboxSchedule parses the outbox settings.
+func (cfg *Config) OutboxSchedule() (*outboxSchedule, error) {
+    o := cfg.Outbox
+    s := &outboxSchedule{
+        interval:  time.Duration(o.Interval) * time.Minute,
+        loc:       time.Local,
+        maxPerDay: o.MaxPerDay,
+    }
+    if s.interval <= 0 {
+        s.interval = 30 * time.Minute
+    }
+    if o.Timezone != "" {
+        loc, err := time.LoadLocation(o.Timezone)
+        if err != nil {
+            return nil, fmt.Errorf("outbox timezone: %w", err)
+        }
+        s.loc = loc
+    }
+    if (o.Start == "") != (o.End == "") {
+        return nil, fmt.Errorf("outbox start and end must both be set or both be empty")
+    }
+    if o.Start != "" {
+        var err error
+        if s.start, err = parseClock(o.Start); err != nil {
+            return nil, fmt.Errorf("outbox start: %w", err)
+        }
+        if s.end, err = parseClock(o.End); err != nil {
+            return nil, fmt.Errorf("outbox end: %w", err)
+        }
+    }
+    return s, nil
+}
+
+// parseClock parses a HH:MM time of day into an offset from midnight.
+func parseClock(value string) (time.Duration, error) {
+    t, err := time.Parse("15:04", value)
+    if err != nil {
+        return 0, fmt.Errorf("%q is not HH:MM", value)
+    }
+    return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// midnight returns the start of t's day in the schedule's time zone.
+func (s *outboxSchedule) midnight(t time.Time) time.Time {
+    t = t.In(s.loc)
+    return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, s.loc)
+}
+
+// at returns the time offset after midnight of t's day. Days are stepped with
+// time.Date so DST changes don't shift the window.
+func (s *outboxSchedule) at(t time.Time, days int, offset time.Duration) time.Time {
+    day := s.midnight(t)
+    day = time.Date(day.Year(), day.Month(), day.Day()+days, 0, 0, 0, 0, s.loc)
+    return day.Add(offset)
+}
+
+// nextOpen returns t if it lies inside the posting window, otherwise the
+// start of the next window.
+func (s *outboxSchedule) nextOpen(t time.Time) time.Time {
+    if s.start == s.end {
+        return t
+    }
+    start, end := s.at(t, 0, s.start), s.at(t, 0, s.end)
+    if s.start < s.end {
+        switch {
+        case t.Before(start):
+            return start
+        case t.Before(end):
+            return t
+        default:
+            return s.at(t, 1, s.start)
+        }
+    }
+    // The window spans midnight: it is closed only between end and start
+    if !t.Before(end) && t.Before(start) {
+        return start
+    }
+    return t
+}
+
+// nextRelease returns the earliest time the next image may be released, given
+// the time of the last release and how many were released today.
+func (s *outboxSchedule) nextRelease(now, last time.Time, db *Database) (time.Time, error) {
+    t := now
+    if !last.IsZero() && last.Add(s.interval).After(t) {
+        t = last.Add(s.interval)
+    }
+    t = s.nextOpen(t)
+    if s.maxPerDay <= 0 {
+        return t, nil
+    }
+    day := s.midnight(t)
+    released, err := db.CountReleasedSince(day)
+    if err != nil {
+        return time.Time{}, err
+    }
+    if released >= s.maxPerDay {
+        t = s.nextOpen(s.at(t, 1, 0))
+    }
+    return t, nil
+}
+
+// enqueueImage moves the prepared files into the outbox directory and queues
+// the image for release.
+func enqueueImage(cfg *Config, db *Database, feed string, prepared *preparedImage) error {
+    dir := cfg.Outbox.Dir
+    if dir == "" {
+        dir = "outbox"
+    }
+    if err := os.MkdirAll(dir, 0755); err != nil {
+        return err
+    }
+    imagePath := filepath.Join(dir, prepared.Image.ID+filepath.Ext(prepared.ImagePath))
+    thumbPath := filepath.Join(dir, prepared.Image.ID+"-thumb"+filepath.Ext(prepared.ThumbPath))
+    if err := moveFile(prepared.ImagePath, imagePath); err != nil {
+        return err
+    }
+    if err := moveFile(prepared.ThumbPath, thumbPath); err != nil {
+        os.Remove(imagePath)
+        return err
+    }
+    err := db.Enqueue(OutboxItem{
+        Feed:        feed,
+        Image:       prepared.Image,
+        ImagePath:   imagePath,
+        ThumbPath:   thumbPath,
+        Description: prepared.Description,
+        QueuedAt:    time.Now(),
+    })
+    if err != nil {
+        os.Remove(imagePath)
+        os.Remove(thumbPath)
+        return err
+    }
+    return nil
+}
+
+// moveFile renames src to dst, copying when they are on different filesystems.
+func moveFile(src, dst string) error {
+    if err := os.Rename(src, dst); err == nil {
+        return nil
+    }
+    if err := copyFile(src, dst); err != nil {
+        return err
+    }
+    return os.Remove(src)
+}
+
+// RunOutbox releases queued images one at a time according to the schedule.
+// Images left in the queue keep being released if the outbox is disabled by a
+// config reload.
+func RunOutbox(state *liveState, db *Database) {
+    slog.Info("Outbox: releasing queued images")
+    for {
+        cfg, _, matrixBot := state.get()
+        schedule, err := cfg.OutboxSchedule()
+        if err != nil {
+            slog.Error("Outbox: invalid settings", "error", err)
+            time.Sleep(outboxPollInterval)
+            continue
+        }
+        wait, err := releaseNext(cfg, db, matrixBot, schedule)
+        if err != nil {
+            slog.Error("Outbox: release failed", "error", err)
+        }
+        if wait > outboxPollInterval || wait <= 0 {
+            wait = outboxPollInterval
+        }
+        time.Sleep(wait)
+    }
+}
+
+// releaseNext sends the oldest queued image if it is due, and otherwise
+// returns how long until it is.
+func releaseNext(cfg *Config, db *Database, matrixBot *MatrixBot, schedule *outboxSchedule) (time.Duration, error) {
+    if paused, err := db.IsPaused(); err != nil || paused {
+        return 0, err
+    }
+    now := time.Now()
+    item, err := db.NextQueued(now)
+    if err != nil || item == nil {
+        return 0, err
+    }
+    last, err := db.LastRelease()
+    if err != nil {
+        return 0, err
+    }
+    next, err := schedule.nextRelease(now, last, db)
+    if err != nil {
+        return 0, err
+    }
+    if next.After(now) {
+        return next.Sub(now), nil
+    }
+
+    prepared := &preparedImage{
+        Image:       item.Image,
+        ImagePath:   item.ImagePath,
+        ThumbPath:   item.ThumbPath,
+        Description: item.Description,
+    }
+
+    logger := slog.With("run_id", newRunID(), "feed", item.Feed, "image_id", item.Image.ID)
+
+    // Queued without tags, the image needs them if a blocklist or template
+    // does now; without them the blocklist can't be checked, so it is tried
+    // again later
+    img, err := imageDetails(cfg, db, item.Image)
+    if err != nil {
+        return 0, retryRelease(db, logger, item, prepared, isWallhavenGone(err), fmt.Errorf("fetching details of image %s: %w", item.Image.ID, err))
+    }
+    item.Image, prepared.Image = img, img
+
+    // Tags blocked while the image was waiting still apply
+    if tag, err := db.BlockedTag(item.Image); err != nil {
+        logger.Error("Failed to check blocklist", "error", err)
+    } else if tag != "" {
+        logger.Info("Outbox: dropping image, tag is blocklisted", "tag", tag)
+        imagesFiltered.WithLabelValues("blocked_tag").Inc()
+        if err := db.MarkSent(item.Image.ID); err != nil {
+            return 0, fmt.Errorf("failed to mark image %s as sent: %w", item.Image.ID, err)
+        }
+        prepared.Cleanup()
+        return time.Second, db.Dequeue(item.Image.ID)
+    }
+
+    // The image only leaves the queue once it was published somewhere, so a
+    // crash doesn't lose it and an outage of every destination only delays it
+    logger.Info("Outbox: releasing image", "queued_for", now.Sub(item.QueuedAt).Round(time.Second))
+    if sendPreparedImage(cfg, db, matrixBot, logger, item.Feed, prepared) {
+        return 0, retryRelease(db, logger, item, prepared, false, fmt.Errorf("every destination failed for image %s", item.Image.ID))
+    }
+    prepared.Cleanup()
+    if err := db.MarkReleased(item.Image.ID, now); err != nil {
+        return 0, fmt.Errorf("failed to mark image %s as released: %w", item.Image.ID, err)
+    }
+    return schedule.interval, nil
+}
+
+// retryRelease holds a queued image back after a failed release, waiting
+// longer after each failure, and returns cause with what happens next. After
+// outboxMaxAttempts failures, or if it can never be released, the image is
+// dropped instead; a later fetch may queue it again.
+func retryRelease(db *Database, logger *slog.Logger, item *OutboxItem, prepared *preparedImage, permanent bool, cause error) error {
+    attempts := item.Attempts + 1
+    if permanent || attempts >= outboxMaxAttempts {
+        logger.Warn("Outbox: dropping image that can't be released", "attempts", attempts)
+        imagesFiltered.WithLabelValues("release_failed").Inc()
+        prepared.Cleanup()
+        if err := db.Dequeue(item.Image.ID); err != nil {
+            return fmt.Errorf("%w; failed to drop it: %v", cause, err)
+        }
+        return fmt.Errorf("%w; dropped it after %d attempts", cause, attempts)
+    }
+    delay := outboxRetryDelay << (attempts - 1)
+    if err := db.PostponeQueued(item.Image.ID, time.Now().Add(delay)); err != nil {
+        return fmt.Errorf("%w; failed to postpone it: %v", cause, err)
+    }
+    return fmt.Errorf("%w; retrying in %s", cause, delay)
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+func newTestDatabase(t *testing.T) *Database {
+    t.Helper()
+    db, err := NewDatabase(filepath.Join(t.TempDir(), "test.db"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { db.db.Close() })
+    return db
+}
+
+// testImage returns a wallpaper as /w/:id describes it, with the given tags.
+func testImage(t *testing.T, id string, tags ...string) WallhavenImage {
+    t.Helper()
+    data := map[string]interface{}{"id": id, "url": "https://wallhaven.cc/w/" + id, "path": "https://w.wallhaven.cc/full/" + id + ".jpg"}
+    list := []map[string]interface{}{}
+    for i, tag := range tags {
+        list = append(list, map[string]interface{}{"id": i + 1, "name": tag})
+    }
+    data["tags"] = list
+    raw, _ := json.Marshal(data)
+    var img WallhavenImage
+    if err := json.Unmarshal(raw, &img); err != nil {
+        t.Fatal(err)
+    }
+    return img
+}
+
+// queueTestImage queues img with placeholder files and returns their paths.
+func queueTestImage(t *testing.T, db *Database, img WallhavenImage, queuedAt time.Time) (imagePath, thumbPath string) {
+    t.Helper()
+    dir := t.TempDir()
+    imagePath, thumbPath = filepath.Join(dir, img.ID+".jpg"), filepath.Join(dir, img.ID+"-thumb.jpg")
+    for _, path := range []string{imagePath, thumbPath} {
+        if err := os.WriteFile(path, []byte("jpeg"), 0644); err != nil {
+            t.Fatal(err)
+        }
+    }
+    err := db.Enqueue(OutboxItem{Feed: "1d", Image: img, ImagePath: imagePath, ThumbPath: thumbPath, QueuedAt: queuedAt})
+    if err != nil {
+        t.Fatal(err)
+    }
+    return imagePath, thumbPath
+}
+
+func TestNextRelease(t *testing.T) {
+    day := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+    at := func(clock string) time.Time {
+        offset, err := parseClock(clock)
+        if err != nil {
+            t.Fatal(err)
+        }
+        return day.Add(offset)
+    }
+    tests := []struct {
+        name       string
+        start, end string
+        maxPerDay  int
+        now, last  time.Time
+        released   int // Releases earlier on the day of now
+        want       time.Time
+    }{
+        {"inside the window", "08:00", "22:00", 0, at("10:00"), time.Time{}, 0, at("10:00")},
+        {"waits for the interval", "08:00", "22:00", 0, at("10:10"), at("10:00"), 0, at("10:30")},
+        {"before the window", "08:00", "22:00", 0, at("06:00"), time.Time{}, 0, at("08:00")},
+        {"after the window", "08:00", "22:00", 0, at("22:30"), time.Time{}, 0, at("08:00").AddDate(0, 0, 1)},
+        {"interval ends after the window", "08:00", "22:00", 0, at("21:50"), at("21:40"), 0, at("08:00").AddDate(0, 0, 1)},
+        {"window spanning midnight, open", "22:00", "02:00", 0, at("01:00"), time.Time{}, 0, at("01:00")},
+        {"window spanning midnight, closed", "22:00", "02:00", 0, at("03:00"), time.Time{}, 0, at("22:00")},
+        {"no window", "", "", 0, at("03:00"), time.Time{}, 0, at("03:00")},
+        {"below the daily maximum", "08:00", "22:00", 2, at("12:00"), at("09:00"), 1, at("12:00")},
+        {"daily maximum reached", "08:00", "22:00", 2, at("12:00"), at("09:00"), 2, at("08:00").AddDate(0, 0, 1)},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            cfg := &Config{}
+            cfg.Outbox.Interval = 30
+            cfg.Outbox.Start, cfg.Outbox.End = tt.start, tt.end
+            cfg.Outbox.Timezone = "UTC"
+            cfg.Outbox.MaxPerDay = tt.maxPerDay
+            schedule, err := cfg.OutboxSchedule()
+            if err != nil {
+                t.Fatal(err)
+            }
+            db := newTestDatabase(t)
+            for i := 0; i < tt.released; i++ {
+                img := testImage(t, string(rune('a'+i)))
+                queueTestImage(t, db, img, day)
+                if err := db.MarkReleased(img.ID, day.Add(time.Hour)); err != nil {
+                    t.Fatal(err)
+                }
+            }
+            got, err := schedule.nextRelease(tt.now, tt.last, db)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if !got.Equal(tt.want) {
+                t.Errorf("nextRelease = %s, want %s", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestReleaseNext(t *testing.T) {
+    if err := setupHTTPClient(&Config{}); err != nil {
+        t.Fatal(err)
+    }
+    tests := []struct {
+        name       string
+        status     int // Webhook response; 0 disables the webhook
+        attempts   int // Failed releases before this one
+        tags       []string
+        blocked    string // Blocklisted tag
+        wantErr    bool
+        wantQueued bool // Still waiting for a later attempt
+        wantSent   bool
+    }{
+        {name: "published", status: http.StatusOK, wantSent: true},
+        {name: "no destination enabled", wantSent: true},
+        {name: "every destination failed", status: http.StatusBadRequest, wantErr: true, wantQueued: true},
+        {name: "failed again", status: http.StatusBadRequest, attempts: 2, wantErr: true, wantQueued: true},
+        {name: "failed for the last time", status: http.StatusBadRequest, attempts: outboxMaxAttempts - 1, wantErr: true},
+        {name: "blocklisted while queued", status: http.StatusOK, tags: []string{"Cars"}, blocked: "cars", wantSent: true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                w.WriteHeader(tt.status)
+            }))
+            defer server.Close()
+            cfg := &Config{Templates: &Templates{}}
+            cfg.Webhook.Enabled = tt.status != 0
+            cfg.Webhook.URL = server.URL
+            schedule, err := cfg.OutboxSchedule()
+            if err != nil {
+                t.Fatal(err)
+            }
+
+            db := newTestDatabase(t)
+            if tt.blocked != "" {
+                if err := db.BlockTag(tt.blocked); err != nil {
+                    t.Fatal(err)
+                }
+            }
+            img := testImage(t, "first", tt.tags...)
+            imagePath, thumbPath := queueTestImage(t, db, img, time.Now().Add(-time.Hour))
+            queueTestImage(t, db, testImage(t, "second"), time.Now())
+            for i := 0; i < tt.attempts; i++ {
+                if err := db.PostponeQueued(img.ID, time.Time{}); err != nil {
+                    t.Fatal(err)
+                }
+            }
+
+            _, err = releaseNext(cfg, db, nil, schedule)
+            if (err != nil) != tt.wantErr {
+                t.Fatalf("releaseNext error = %v, want error %v", err, tt.wantErr)
+            }
+
+            if sent, _ := db.IsSent(img.ID); sent != tt.wantSent {
+                t.Errorf("IsSent = %v, want %v", sent, tt.wantSent)
+            }
+            later, err := db.NextQueued(time.Now().Add(365 * 24 * time.Hour))
+            if err != nil {
+                t.Fatal(err)
+            }
+            queued := later != nil && later.Image.ID == img.ID
+            if queued != tt.wantQueued {
+                t.Errorf("still queued = %v, want %v", queued, tt.wantQueued)
+            }
+            if queued && later.Attempts != tt.attempts+1 {
+                t.Errorf("attempts = %d, want %d", later.Attempts, tt.attempts+1)
+            }
+            next, err := db.NextQueued(time.Now())
+            if err != nil {
+                t.Fatal(err)
+            }
+            // Whatever became of the first image, it doesn't block the queue
+            if next == nil || next.Image.ID != "second" {
+                t.Errorf("next image is %v, want the second one", next)
+            }
+            _, statErr := os.Stat(imagePath)
+            _, thumbErr := os.Stat(thumbPath)
+            if kept := statErr == nil && thumbErr == nil; kept != tt.wantQueued {
+                t.Errorf("files kept = %v, want %v", kept, tt.wantQueued)
+            }
+        })
+    }
+}
+
+func TestIsWallhavenGone(t *testing.T) {
+    if err := setupHTTPClient(&Config{}); err != nil {
+        t.Fatal(err)
+    }
+    tests := []struct {
+        status int
+        want   bool
+    }{
+        {http.StatusNotFound, true},
+        {http.StatusGone, true},
+        {http.StatusUnauthorized, false},
+        {http.StatusInternalServerError, false},
+    }
+    for _, tt := range tests {
+        server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            w.Header().Set("Retry-After", "0")
+            w.WriteHeader(tt.status)
+        }))
+        req, _ := http.NewRequest("GET", server.URL, nil)
+        _, err := makeRateLimitedRequest(req, "image")
+        server.Close()
+        if got := isWallhavenGone(err); got != tt.want {
+            t.Errorf("HTTP %d: isWallhavenGone(%v) = %v, want %v", tt.status, err, got, tt.want)
+        }
+    }
+}
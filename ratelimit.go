@@ -0,0 +1,148 @@
+package main
+
+import (
+    "context"
+    "log/slog"
+    "sync"
+    "time"
+)
+
+const (
+    // defaultWallhavenRate is Wallhaven's documented API limit per minute.
+    defaultWallhavenRate = 45
+    // wallhavenBurst is how many requests may go out back to back; kept low
+    // so a full bucket can't push a minute over the server's limit.
+    wallhavenBurst = 5
+)
+
+// tokenBucket spaces out requests to one service. Every request takes a
+// token; tokens refill at a steady rate up to the burst size. A 429 pauses
+// all callers until the server's Retry-After has passed.
+type tokenBucket struct {
+    name        string // For logs
+    mu          sync.Mutex
+    rate        float64 // Tokens per second
+    burst       float64
+    tokens      float64
+    last        time.Time
+    pausedUntil time.Time
+}
+
+func newTokenBucket(name string, perMinute, burst int) *tokenBucket {
+    return &tokenBucket{
+        name:   name,
+        rate:   float64(perMinute) / 60,
+        burst:  float64(burst),
+        tokens: float64(burst),
+        last:   time.Now(),
+    }
+}
+
+// wallhavenLimiter is shared by every Wallhaven API call.
+var wallhavenLimiter = newTokenBucket("Wallhaven", defaultWallhavenRate, wallhavenBurst)
+
+// serviceLimiters are consulted by doRequest before every attempt.
+var serviceLimiters = map[string]*tokenBucket{
+    "wallhaven": wallhavenLimiter,
+}
+
+// refill adds the tokens earned since the last call; nothing is earned
+// during a pause. Must hold mu.
+func (b *tokenBucket) refill(now time.Time) {
+    if !now.After(b.last) {
+        return
+    }
+    b.tokens += now.Sub(b.last).Seconds() * b.rate
+    if b.tokens > b.burst {
+        b.tokens = b.burst
+    }
+    b.last = now
+}
+
+// Wait blocks until a token is available and takes it.
+func (b *tokenBucket) Wait(ctx context.Context) error {
+    started := time.Now()
+    defer func() {
+        if waited := time.Since(started); waited > 10*time.Millisecond {
+            rateLimitWait.Add(waited.Seconds())
+            if waited > time.Second {
+                slog.Debug("Waited for rate limit", "service", b.name, "waited", waited.Round(time.Millisecond))
+            }
+        }
+    }()
+    for {
+        b.mu.Lock()
+        now := time.Now()
+        var wait time.Duration
+        if now.Before(b.pausedUntil) {
+            wait = b.pausedUntil.Sub(now)
+        } else {
+            b.refill(now)
+            if b.tokens >= 1 {
+                b.tokens--
+                b.mu.Unlock()
+                return nil
+            }
+            wait = time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+        }
+        b.mu.Unlock()
+
+        select {
+        case <-time.After(wait):
+        case <-ctx.Done():
+            return ctx.Err()
+        }
+    }
+}
+
+// Pause stops every caller for d, e.g. after a 429.
+func (b *tokenBucket) Pause(d time.Duration) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    until := time.Now().Add(d)
+    if !until.After(b.pausedUntil) {
+        return
+    }
+    slog.Warn("Rate limited, pausing all requests", "service", b.name, "until", until.Format(time.RFC3339), "pause", d)
+    b.pausedUntil = until
+    b.tokens = 0
+    b.last = until
+}
+
+// Update adjusts the bucket to the server's X-Ratelimit headers: it never
+// holds more tokens than the server says remain, and slows down if the
+// server's limit is below the configured rate.
+func (b *tokenBucket) Update(info RateLimitInfo) {
+    if info.Limit <= 0 {
+        return
+    }
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    if rate := float64(info.Limit) / 60; rate < b.rate {
+        slog.Info("Server reports a lower rate limit, slowing down", "service", b.name, "limit", info.Limit)
+        b.rate = rate
+    }
+    b.refill(time.Now())
+    if remaining := float64(info.Remaining); remaining < b.tokens {
+        b.tokens = remaining
+    }
+}
+
+// SetRate changes the refill rate; perMinute <= 0 restores the default.
+func (b *tokenBucket) SetRate(perMinute int) {
+    if perMinute <= 0 {
+        perMinute = defaultWallhavenRate
+    }
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    b.refill(time.Now())
+    b.rate = float64(perMinute) / 60
+}
+
+// State returns the tokens available now and the end of any pause.
+func (b *tokenBucket) State() (tokens float64, pausedUntil time.Time) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    b.refill(time.Now())
+    return b.tokens, b.pausedUntil
+}
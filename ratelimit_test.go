@@ -0,0 +1,117 @@
+package main
+
+import (
+    "context"
+    "testing"
+    "time"
+)
+
+func TestTokenBucketRefill(t *testing.T) {
+    now := time.Now()
+    tests := []struct {
+        name       string
+        tokens     float64
+        last       time.Time
+        wantTokens float64
+    }{
+        {"earns tokens at the rate", 0, now.Add(-2 * time.Second), 2},
+        {"caps at the burst", 1, now.Add(-time.Hour), 5},
+        {"nothing during a pause", 0, now.Add(time.Minute), 0},
+    }
+    for _, tt := range tests {
+        b := newTokenBucket("test", 60, 5)
+        b.tokens, b.last = tt.tokens, tt.last
+        b.refill(now)
+        if b.tokens != tt.wantTokens {
+            t.Errorf("%s: tokens = %v, want %v", tt.name, b.tokens, tt.wantTokens)
+        }
+    }
+}
+
+func TestTokenBucketWait(t *testing.T) {
+    b := newTokenBucket("test", 60, 2)
+    ctx := context.Background()
+    start := time.Now()
+    for i := 0; i < 2; i++ {
+        if err := b.Wait(ctx); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+        t.Errorf("the burst took %s, want no wait", elapsed)
+    }
+
+    // The bucket is empty and refills one token a second
+    ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+    defer cancel()
+    if err := b.Wait(ctx); err != context.DeadlineExceeded {
+        t.Errorf("Wait on an empty bucket = %v, want %v", err, context.DeadlineExceeded)
+    }
+}
+
+func TestTokenBucketPause(t *testing.T) {
+    b := newTokenBucket("test", 6000, 5)
+    b.Pause(100 * time.Millisecond)
+    if tokens, until := b.State(); tokens != 0 || time.Until(until) <= 0 {
+        t.Errorf("State() after Pause = %v, %s", tokens, until)
+    }
+    start := time.Now()
+    if err := b.Wait(context.Background()); err != nil {
+        t.Fatal(err)
+    }
+    if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+        t.Errorf("Wait returned after %s, want it to wait out the pause", elapsed)
+    }
+
+    // A shorter pause never cuts a longer one short
+    b.Pause(time.Hour)
+    b.Pause(time.Second)
+    if _, until := b.State(); time.Until(until) < 59*time.Minute {
+        t.Errorf("pause ends in %s, want about an hour", time.Until(until))
+    }
+}
+
+func TestTokenBucketUpdate(t *testing.T) {
+    tests := []struct {
+        name       string
+        info       RateLimitInfo
+        wantRate   float64 // Per minute
+        wantTokens float64
+    }{
+        {"no headers", RateLimitInfo{}, 45, 5},
+        {"higher server limit keeps the configured rate", RateLimitInfo{Limit: 100, Remaining: 90}, 45, 5},
+        {"lower server limit slows down", RateLimitInfo{Limit: 30, Remaining: 20}, 30, 5},
+        {"few requests remaining", RateLimitInfo{Limit: 45, Remaining: 2}, 45, 2},
+        {"none remaining", RateLimitInfo{Limit: 45, Remaining: 0}, 45, 0},
+    }
+    for _, tt := range tests {
+        b := newTokenBucket("test", 45, 5)
+        b.Update(tt.info)
+        tokens, _ := b.State()
+        if got := b.rate * 60; got < tt.wantRate-0.001 || got > tt.wantRate+0.001 {
+            t.Errorf("%s: rate = %v/min, want %v", tt.name, got, tt.wantRate)
+        }
+        // State refills a little since Update, so allow for it
+        if tokens < tt.wantTokens || tokens > tt.wantTokens+0.01 {
+            t.Errorf("%s: tokens = %v, want %v", tt.name, tokens, tt.wantTokens)
+        }
+    }
+}
+
+func TestTokenBucketSetRate(t *testing.T) {
+    tests := []struct {
+        perMinute int
+        want      float64
+    }{
+        {120, 120},
+        {0, defaultWallhavenRate},
+        {-5, defaultWallhavenRate},
+    }
+    for _, tt := range tests {
+        b := newTokenBucket("test", 10, 5)
+        b.SetRate(tt.perMinute)
+        if got := b.rate * 60; got < tt.want-0.001 || got > tt.want+0.001 {
+            t.Errorf("SetRate(%d): rate = %v/min, want %v", tt.perMinute, got, tt.want)
+        }
+    }
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+    "fmt"
+    "log/slog"
+    "net/url"
+    "sort"
+    "strings"
+    "sync"
+)
+
+// redactedPlaceholder replaces secrets in logs and errors.
+const redactedPlaceholder = "[REDACTED]"
+
+// minSecretLength keeps short placeholder values from scrubbing ordinary text.
+const minSecretLength = 6
+
+// secretRedactor scrubs known secrets from strings. Secrets are added at
+// startup from the config and later as tokens are issued, e.g. after a
+// Matrix login or token refresh.
+type secretRedactor struct {
+    mu       sync.RWMutex
+    secrets  map[string]bool
+    replacer *strings.Replacer
+}
+
+var redactor = &secretRedactor{secrets: map[string]bool{}}
+
+// addSecrets registers values that must never appear in logs or errors.
+func addSecrets(values ...string) {
+    redactor.mu.Lock()
+    defer redactor.mu.Unlock()
+    changed := false
+    for _, value := range values {
+        value = strings.TrimSpace(value)
+        if len(value) < minSecretLength {
+            continue
+        }
+        // Also catch the secret where it was put in a URL
+        for _, form := range []string{value, url.QueryEscape(value), url.PathEscape(value)} {
+            if !redactor.secrets[form] {
+                redactor.secrets[form] = true
+                changed = true
+            }
+        }
+    }
+    if !changed {
+        return
+    }
+    // Longer secrets go first, so one that contains another is replaced whole
+    secrets := make([]string, 0, len(redactor.secrets))
+    for secret := range redactor.secrets {
+        secrets = append(secrets, secret)
+    }
+    sort.Slice(secrets, func(i, j int) bool { return len(secrets[i]) > len(secrets[j]) })
+    var pairs []string
+    for _, secret := range secrets {
+        pairs = append(pairs, secret, redactedPlaceholder)
+    }
+    redactor.replacer = strings.NewReplacer(pairs...)
+}
+
+// addConfigSecrets registers every credential in the config.
+func addConfigSecrets(cfg *Config) {
+    addSecrets(
+        cfg.Wallhaven.APIToken,
+        cfg.OpenAIKey,
+        cfg.Mastodon.AccessToken,
+        cfg.Matrix.Password,
+        cfg.Matrix.LoginToken,
+        cfg.Matrix.Encryption.PickleKey,
+        cfg.Matrix.Encryption.RecoveryKey,
+        cfg.Matrix.Encryption.Passphrase,
+        cfg.Ntfy.AccessToken,
+        cfg.Ntfy.Password,
+        cfg.Ntfy.FavouriteSecret,
+        cfg.Gotify.Token,
+        cfg.Webhook.Secret,
+    )
+}
+
+// redact replaces every known secret in s.
+func redact(s string) string {
+    redactor.mu.RLock()
+    replacer := redactor.replacer
+    redactor.mu.RUnlock()
+    if replacer == nil {
+        return s
+    }
+    return replacer.Replace(s)
+}
+
+// redactedError presents an error with secrets removed, while keeping the
+// original available to errors.Is and errors.As.
+type redactedError struct {
+    err error
+}
+
+func (e redactedError) Error() string { return redact(e.err.Error()) }
+func (e redactedError) Unwrap() error { return e.err }
+
+// redactError wraps err so its message is scrubbed of secrets.
+func redactError(err error) error {
+    if err == nil {
+        return nil
+    }
+    if _, ok := err.(redactedError); ok {
+        return err
+    }
+    return redactedError{err: err}
+}
+
+// redactAttr is a slog ReplaceAttr function that scrubs secrets from the
+// message and from string, error and Stringer attributes.
+func redactAttr(groups []string, a slog.Attr) slog.Attr {
+    switch a.Value.Kind() {
+    case slog.KindString:
+        a.Value = slog.StringValue(redact(a.Value.String()))
+    case slog.KindAny:
+        switch v := a.Value.Any().(type) {
+        case error:
+            a.Value = slog.StringValue(redact(v.Error()))
+        case fmt.Stringer:
+            a.Value = slog.StringValue(redact(v.String()))
+        case []string:
+            redacted := make([]string, len(v))
+            for i, s := range v {
+                redacted[i] = redact(s)
+            }
+            a.Value = slog.AnyValue(redacted)
+        }
+    }
+    return a
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+    "errors"
+    "log/slog"
+    "testing"
+)
+
+// withSecrets replaces the registered secrets for the rest of the test.
+func withSecrets(t *testing.T, secrets ...string) {
+    t.Helper()
+    saved := redactor
+    redactor = &secretRedactor{secrets: map[string]bool{}}
+    t.Cleanup(func() { redactor = saved })
+    addSecrets(secrets...)
+}
+
+func TestRedact(t *testing.T) {
+    withSecrets(t, "hunter2-password", "tk_abcdef", "tk_abcdefghij", "short", "p@ss word!")
+    tests := []struct {
+        in   string
+        want string
+    }{
+        {"login with hunter2-password failed", "login with [REDACTED] failed"},
+        {"Bearer tk_abcdefghij", "Bearer [REDACTED]"},
+        {"Bearer tk_abcdef", "Bearer [REDACTED]"},
+        {"https://example.org/?token=p%40ss+word%21", "https://example.org/?token=[REDACTED]"},
+        {"https://example.org/p@ss%20word%21/x", "https://example.org/[REDACTED]/x"},
+        {"too short to be a secret", "too short to be a secret"},
+        {"nothing secret", "nothing secret"},
+    }
+    for _, tt := range tests {
+        if got := redact(tt.in); got != tt.want {
+            t.Errorf("redact(%q) = %q, want %q", tt.in, got, tt.want)
+        }
+    }
+}
+
+func TestRedactError(t *testing.T) {
+    withSecrets(t, "hunter2-password")
+    cause := errors.New("login with hunter2-password failed")
+    tests := []struct {
+        name string
+        err  error
+        want string
+    }{
+        {"plain", cause, "login with [REDACTED] failed"},
+        {"already redacted", redactError(cause), "login with [REDACTED] failed"},
+    }
+    for _, tt := range tests {
+        err := redactError(tt.err)
+        if err.Error() != tt.want {
+            t.Errorf("%s: Error() = %q, want %q", tt.name, err.Error(), tt.want)
+        }
+        if !errors.Is(err, cause) {
+            t.Errorf("%s: errors.Is lost the cause", tt.name)
+        }
+        if inner, ok := err.(redactedError); ok {
+            if _, twice := inner.err.(redactedError); twice {
+                t.Errorf("%s: wrapped twice", tt.name)
+            }
+        }
+    }
+    if redactError(nil) != nil {
+        t.Error("redactError(nil) != nil")
+    }
+}
+
+func TestRedactAttr(t *testing.T) {
+    withSecrets(t, "hunter2-password")
+    tests := []struct {
+        attr slog.Attr
+        want string
+    }{
+        {slog.String("url", "https://x/?p=hunter2-password"), "https://x/?p=[REDACTED]"},
+        {slog.Any("error", errors.New("bad hunter2-password")), "bad [REDACTED]"},
+        {slog.Any("tags", []string{"a", "hunter2-password"}), "[a [REDACTED]]"},
+        {slog.Int("count", 3), "3"},
+    }
+    for _, tt := range tests {
+        if got := redactAttr(nil, tt.attr).Value.String(); got != tt.want {
+            t.Errorf("redactAttr(%s) = %q, want %q", tt.attr.Key, got, tt.want)
+        }
+    }
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+    "fmt"
+    "log/slog"
+    "os"
+    "os/signal"
+    "reflect"
+    "sync"
+    "syscall"
+    "time"
+
+    "gopkg.in/yaml.v2"
+)
+
+// configWatchInterval is how often config.yaml is checked for changes when
+// watch_config is set.
+const configWatchInterval = 10 * time.Second
+
+// restartKeys are settings that are only read at startup.
+var restartKeys = []string{"database", "http.listen", "webhook.variants_dir", "webhook.variants_ttl_hours"}
+
+// liveState is the active config and what was built from it. The main loop
+// swaps it between runs when the config is reloaded; the outbox and the HTTP
+// handlers read it with get.
+type liveState struct {
+    mu        sync.RWMutex
+    filename  string
+    cfg       *Config
+    schedules []feedSchedule
+    matrixBot *MatrixBot
+}
+
+func (s *liveState) get() (*Config, []feedSchedule, *MatrixBot) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    return s.cfg, s.schedules, s.matrixBot
+}
+
+func (s *liveState) config() *Config {
+    cfg, _, _ := s.get()
+    return cfg
+}
+
+// watchReloads returns a channel that receives a value on SIGHUP and, while
+// watch_config is set, when the config file's modification time changes.
+// Requests that arrive during a run are merged into one.
+func watchReloads(state *liveState) <-chan struct{} {
+    reloads := make(chan struct{}, 1)
+    request := func() {
+        select {
+        case reloads <- struct{}{}:
+        default:
+        }
+    }
+
+    hup := make(chan os.Signal, 1)
+    signal.Notify(hup, syscall.SIGHUP)
+    go func() {
+        for range hup {
+            slog.Info("Received SIGHUP, reloading config at the next safe point")
+            request()
+        }
+    }()
+
+    go func() {
+        var lastMod time.Time
+        if info, err := os.Stat(state.filename); err == nil {
+            lastMod = info.ModTime()
+        }
+        for range time.Tick(configWatchInterval) {
+            info, err := os.Stat(state.filename)
+            if err != nil || info.ModTime().Equal(lastMod) {
+                continue
+            }
+            lastMod = info.ModTime()
+            if state.config().WatchConfig {
+                slog.Info("Config file changed, reloading at the next safe point", "file", state.filename)
+                request()
+            }
+        }
+    }()
+    return reloads
+}
+
+// reload re-reads and validates the config file and switches to it. Matrix
+// sessions are kept unless their connection settings changed; if anything
+// fails, the current config stays active.
+func (s *liveState) reload(db *Database) {
+    old, _, oldBot := s.get()
+    cfg, err := LoadConfig(s.filename)
+    if err != nil {
+        slog.Error("Config reload failed, keeping the current config", "error", err)
+        return
+    }
+    changes := configDiff(old, cfg)
+    if len(changes) == 0 {
+        slog.Info("Config reloaded, nothing changed")
+        return
+    }
+    schedules, err := cfg.FeedSchedules()
+    if err != nil {
+        slog.Error("Config reload failed, keeping the current config", "error", err)
+        return
+    }
+
+    bot := oldBot
+    switch {
+    case !cfg.Matrix.Enabled:
+        if oldBot != nil {
+            oldBot.Close()
+            slog.Info("Matrix posting disabled")
+        }
+        bot = nil
+    case oldBot != nil && !matrixSessionChanged(old, cfg):
+        if err := oldBot.Reload(cfg); err != nil {
+            slog.Error("Config reload failed, keeping the current config", "error", err)
+            return
+        }
+    default:
+        // The old bot has to stop first: an appservice listens on a fixed port
+        if oldBot != nil {
+            oldBot.Close()
+        }
+        if bot, err = startMatrixBot(cfg, db); err != nil {
+            slog.Error("Config reload failed: Matrix login with the new settings failed, keeping the current config", "error", err)
+            if oldBot != nil {
+                if bot, err = startMatrixBot(old, db); err != nil {
+                    slog.Error("Matrix login with the previous settings failed too, Matrix posting is off until the next reload", "error", err)
+                }
+            }
+            s.mu.Lock()
+            s.matrixBot = bot
+            s.mu.Unlock()
+            health.setMatrixBot(bot)
+            return
+        }
+    }
+
+    if err := setupLogging(cfg); err != nil {
+        slog.Error("Invalid logging settings, keeping the current ones", "error", err)
+    }
+    if err := setupHTTPClient(cfg); err != nil {
+        slog.Error("Invalid http_client settings, keeping the current ones", "error", err)
+    }
+    wallhavenLimiter.SetRate(cfg.Wallhaven.RateLimit)
+    s.mu.Lock()
+    s.cfg, s.schedules, s.matrixBot = cfg, schedules, bot
+    s.mu.Unlock()
+    health.setMatrixBot(bot)
+
+    for _, change := range changes {
+        slog.Info("Config changed", "key", change.key, "old", change.old, "new", change.new)
+        if containsString(restartKeys, change.key) {
+            slog.Warn("Config change takes effect after a restart", "key", change.key)
+        }
+    }
+    slog.Info("Config reloaded", "changes", len(changes))
+}
+
+// startMatrixBot logs in to Matrix, as a regular user or an appservice.
+func startMatrixBot(cfg *Config, db *Database) (*MatrixBot, error) {
+    if cfg.Matrix.Appservice.Enabled {
+        return NewMatrixAppserviceBot(cfg, db)
+    }
+    return NewMatrixBot(cfg, db)
+}
+
+// matrixSessionChanged reports whether two configs differ in anything but the
+// Matrix settings that Reload can apply to a running bot.
+func matrixSessionChanged(a, b *Config) bool {
+    return !reflect.DeepEqual(matrixSessionSettings(a), matrixSessionSettings(b))
+}
+
+func matrixSessionSettings(cfg *Config) interface{} {
+    m := cfg.Matrix
+    m.Rooms, m.RoomID = nil, ""
+    m.Caption, m.CaptionHTML = "", ""
+    m.Commands.AllowedUsers, m.Commands.MinPowerLevel = nil, 0
+    return m
+}
+
+// configChange is one changed setting, for the reload log.
+type configChange struct {
+    key, old, new string
+}
+
+// configDiff lists the settings that differ between two configs. Secrets are
+// reported as changed without their values.
+func configDiff(a, b *Config) []configChange {
+    before, after := flattenConfig(a), flattenConfig(b)
+    var changes []configChange
+    for _, key := range mergedKeys(before, after) {
+        oldValue, newValue := before.values[key], after.values[key]
+        if oldValue == newValue {
+            continue
+        }
+        if secretKeys[key] {
+            oldValue, newValue = redactedPlaceholder, redactedPlaceholder
+        }
+        changes = append(changes, configChange{key: key, old: oldValue, new: newValue})
+    }
+    return changes
+}
+
+// flatConfig maps dotted keys to their printed values, in config order.
+type flatConfig struct {
+    keys   []string
+    values map[string]string
+}
+
+func flattenConfig(cfg *Config) flatConfig {
+    flat := flatConfig{values: map[string]string{}}
+    data, err := yaml.Marshal(cfg)
+    if err != nil {
+        return flat
+    }
+    var root yaml.MapSlice
+    if err := yaml.Unmarshal(data, &root); err != nil {
+        return flat
+    }
+    flat.add("", root)
+    return flat
+}
+
+func (f *flatConfig) add(path string, node interface{}) {
+    if m, ok := node.(yaml.MapSlice); ok && len(m) > 0 {
+        for _, item := range m {
+            key := fmt.Sprint(item.Key)
+            if path != "" {
+                key = path + "." + key
+            }
+            f.add(key, item.Value)
+        }
+        return
+    }
+    f.keys = append(f.keys, path)
+    f.values[path] = fmt.Sprint(node)
+}
+
+// mergedKeys returns the keys of a followed by those only in b.
+func mergedKeys(a, b flatConfig) []string {
+    keys := append([]string{}, a.keys...)
+    for _, key := range b.keys {
+        if _, ok := a.values[key]; !ok {
+            keys = append(keys, key)
+        }
+    }
+    return keys
+}
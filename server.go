@@ -0,0 +1,26 @@
+package main
+
+import (
+    "log/slog"
+    "net/http"
+    "time"
+)
+
+// startHTTPServer serves the bot's HTTP endpoints (callbacks, metrics, health)
+// in the background if http.listen is configured.
+func startHTTPServer(cfg *Config, handler http.Handler) {
+    if cfg.HTTP.Listen == "" {
+        return
+    }
+    server := &http.Server{
+        Addr:              cfg.HTTP.Listen,
+        Handler:           handler,
+        ReadHeaderTimeout: 10 * time.Second,
+    }
+    go func() {
+        slog.Info("HTTP server listening", "addr", cfg.HTTP.Listen)
+        if err := server.ListenAndServe(); err != nil {
+            slog.Error("HTTP server stopped", "error", err)
+        }
+    }()
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "net/url"
+    "strings"
+    "text/template"
+)
+
+// Default message templates, reproducing the formats each destination used
+// before templates were configurable.
+const (
+    defaultMatrixTemplate = `Link: {{ .Image.URL }}
+Uploader: {{ .Image.Uploader.Username }}
+Resolution: {{ .Image.Resolution }}
+Type: {{ .Image.FileType }}
+Size: {{ humanFileSize .Image.FileSize }}
+Tags: {{ join (tagNames .Image) ", " }}
+{{- if ge (len .Description) 50 }}
+Description: {{ .Description }}{{ end }}`
+
+    defaultMatrixHTMLTemplate = `Link: <a href="{{ html .Image.URL }}">{{ html .Image.URL }}</a><br>` +
+        `Uploader: <a href="https://wallhaven.cc/user/{{ pathEscape .Image.Uploader.Username }}">{{ html .Image.Uploader.Username }}</a><br>` +
+        `Resolution: {{ html .Image.Resolution }}<br>` +
+        `Type: {{ html .Image.FileType }}<br>` +
+        `Size: {{ humanFileSize .Image.FileSize }}<br>` +
+        `Tags: {{ range $i, $tag := .Image.Tags }}{{ if $i }}, {{ end }}<a href="{{ html (tagURL $tag.ID $tag.Name) }}">{{ html $tag.Name }}</a>{{ end }}` +
+        `{{ if ge (len .Description) 50 }}<details><summary>Description</summary>{{ html .Description }}</details>{{ end }}`
+
+    defaultMastodonTemplate = `Link: {{ .Image.URL }}
+Uploader: {{ .Image.Uploader.Username }}
+Resolution: {{ .Image.Resolution }}
+Type: {{ .Image.FileType }}
+Size: {{ printf "%.2f" (megabytes .Image.FileSize) }} MB
+Description: {{ .Description }}
+
+{{ join (hashtags .Image) " " }}`
+
+    defaultNtfyTemplate = `Description: {{ .Description }}`
+
+    defaultGotifyTemplate = "**Link:** [{{ .Image.ID }}]({{ .Image.URL }})  \n" +
+        "**Uploader:** {{ .Image.Uploader.Username }}  \n" +
+        "**Resolution:** {{ .Image.Resolution }}  \n" +
+        "**Type:** {{ .Image.FileType }}  \n" +
+        "**Size:** {{ humanFileSize .Image.FileSize }}  \n" +
+        "**Tags:** {{ range $i, $tag := .Image.Tags }}{{ if $i }}, {{ end }}[{{ $tag.Name }}]({{ tagURL $tag.ID $tag.Name }}){{ end }}" +
+        "{{ if .Description }}\n\n{{ .Description }}{{ end }}"
+)
+
+// TemplateData is what every message template is executed with.
+type TemplateData struct {
+    Image       WallhavenImage
+    Description string // AI description, trimmed; may be empty
+    Feed        string // Toprange the image came from, or "command" for chat requests
+}
+
+var templateFuncs = template.FuncMap{
+    "humanFileSize": humanFileSize,
+    "megabytes": func(bytes int) float64 {
+        return float64(bytes) / (1024 * 1024)
+    },
+    "join":       strings.Join,
+    "pathEscape": url.PathEscape,
+    "tagURL":     wallhavenTagURL,
+    "tagNames": func(img WallhavenImage) []string {
+        var names []string
+        for _, tag := range img.Tags {
+            names = append(names, tag.Name)
+        }
+        return names
+    },
+    "hashtag": hashtag,
+    "hashtags": func(img WallhavenImage) []string {
+        var tags []string
+        for _, tag := range img.Tags {
+            tags = append(tags, hashtag(tag.Name))
+        }
+        return tags
+    },
+}
+
+// hashtag turns a tag name into a hashtag by dropping spaces.
+func hashtag(name string) string {
+    return "#" + strings.ReplaceAll(name, " ", "")
+}
+
+// sampleTemplateData is used to dry-run templates at startup, so references to
+// fields that don't exist fail then rather than when an image is posted.
+var sampleTemplateData = TemplateData{
+    Image: WallhavenImage{
+        ID:  "abc123",
+        URL: "https://wallhaven.cc/w/abc123",
+        Uploader: struct {
+            Username string `json:"username"`
+        }{Username: "uploader"},
+        Purity:     "sfw",
+        Resolution: "1920x1080",
+        FileSize:   1234567,
+        FileType:   "image/jpeg",
+        Path:       "https://w.wallhaven.cc/full/ab/wallhaven-abc123.jpg",
+        Tags: []struct {
+            ID   int    `json:"id"`
+            Name string `json:"name"`
+        }{{ID: 1, Name: "anime"}, {ID: 2, Name: "digital art"}},
+    },
+    Description: "A sample description that is long enough to be included in captions.",
+    Feed:        "1d",
+}
+
+// Templates holds the compiled message template of every destination.
+type Templates struct {
+    Matrix     *template.Template
+    MatrixHTML *template.Template // nil if only a custom plain caption is configured
+    Mastodon   *template.Template
+    Ntfy       *template.Template
+    Gotify     *template.Template
+
+    // ImageDetails is set if an enabled destination uses the uploader or
+    // tags, which search results lack.
+    ImageDetails bool
+}
+
+// parseTemplate compiles text, or def if text is empty, and dry-runs it
+// against sample data.
+func parseTemplate(name, text, def string) (*template.Template, error) {
+    if text == "" {
+        text = def
+    }
+    tmpl, err := template.New(name).Funcs(templateFuncs).Option("missingkey=error").Parse(text)
+    if err != nil {
+        return nil, fmt.Errorf("%s template: %w", name, err)
+    }
+    if err := tmpl.Execute(&bytes.Buffer{}, sampleTemplateData); err != nil {
+        return nil, fmt.Errorf("%s template: %w", name, err)
+    }
+    return tmpl, nil
+}
+
+// compileTemplates parses every destination's template, including per-room
+// Matrix captions, and keeps the results on the config.
+func (cfg *Config) compileTemplates() error {
+    t := &Templates{}
+    var err error
+    if t.Matrix, err = parseTemplate("matrix.caption", cfg.Matrix.Caption, defaultMatrixTemplate); err != nil {
+        return err
+    }
+    // A custom plain caption without an HTML one is sent as plain text only
+    if cfg.Matrix.Caption == "" || cfg.Matrix.CaptionHTML != "" {
+        if t.MatrixHTML, err = parseTemplate("matrix.caption_html", cfg.Matrix.CaptionHTML, defaultMatrixHTMLTemplate); err != nil {
+            return err
+        }
+    }
+    if t.Mastodon, err = parseTemplate("mastodon.template", cfg.Mastodon.Template, defaultMastodonTemplate); err != nil {
+        return err
+    }
+    if t.Ntfy, err = parseTemplate("ntfy.template", cfg.Ntfy.Template, defaultNtfyTemplate); err != nil {
+        return err
+    }
+    if t.Gotify, err = parseTemplate("gotify.template", cfg.Gotify.Template, defaultGotifyTemplate); err != nil {
+        return err
+    }
+    roomCaptions := []*template.Template{t.Matrix, t.MatrixHTML}
+    for _, room := range cfg.MatrixRooms() {
+        if room.Caption != "" {
+            tmpl, err := parseTemplate(room.Room+" caption", room.Caption, "")
+            if err != nil {
+                return err
+            }
+            roomCaptions = append(roomCaptions, tmpl)
+        }
+        if room.CaptionHTML != "" {
+            tmpl, err := parseTemplate(room.Room+" caption_html", room.CaptionHTML, "")
+            if err != nil {
+                return err
+            }
+            roomCaptions = append(roomCaptions, tmpl)
+        }
+    }
+
+    // ntfy and the webhook only send the uploader and tags if asked to
+    t.ImageDetails = cfg.Ntfy.Enabled && (cfg.Ntfy.WallhavenTags || usesImageDetails(t.Ntfy)) ||
+        cfg.Webhook.Enabled && cfg.Webhook.IncludeDetails ||
+        cfg.Mastodon.Enabled && usesImageDetails(t.Mastodon) ||
+        cfg.Gotify.Enabled && usesImageDetails(t.Gotify)
+    if cfg.Matrix.Enabled {
+        for _, tmpl := range roomCaptions {
+            t.ImageDetails = t.ImageDetails || usesImageDetails(tmpl)
+        }
+    }
+    cfg.Templates = t
+    return nil
+}
+
+// usesImageDetails reports whether tmpl prints the uploader or tags, by
+// rendering the sample data with and without them.
+func usesImageDetails(tmpl *template.Template) bool {
+    if tmpl == nil {
+        return false
+    }
+    bare := sampleTemplateData
+    bare.Image.Uploader.Username = ""
+    bare.Image.Tags = nil
+    var full, stripped bytes.Buffer
+    if tmpl.Execute(&full, sampleTemplateData) != nil || tmpl.Execute(&stripped, bare) != nil {
+        return true
+    }
+    return full.String() != stripped.String()
+}
+
+// fallbackCaption is used for Matrix when a custom caption fails on an image.
+var fallbackCaption = template.Must(template.New("default caption").Funcs(templateFuncs).Parse(defaultMatrixTemplate))
+
+// renderTemplate executes tmpl for one image.
+func renderTemplate(tmpl *template.Template, img WallhavenImage, aiDescription, feed string) (string, error) {
+    var buf bytes.Buffer
+    data := TemplateData{Image: img, Description: strings.TrimSpace(aiDescription), Feed: feed}
+    if err := tmpl.Execute(&buf, data); err != nil {
+        return "", err
+    }
+    return buf.String(), nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+    "testing"
+)
+
+func TestParseTemplate(t *testing.T) {
+    tests := []struct {
+        text    string
+        want    string // Rendered with the sample data
+        wantErr bool
+    }{
+        {"", "Description: " + sampleTemplateData.Description, false},
+        {"{{ .Image.Resolution }} from {{ .Feed }}", "1920x1080 from 1d", false},
+        {"{{ join (hashtags .Image) \" \" }}", "#anime #digitalart", false},
+        {"{{ humanFileSize .Image.FileSize }}", "1.18 MB", false},
+        {"{{ .Image.Resolution", "", true},
+        {"{{ .Image.Views }}", "", true},
+        {"{{ shout .Description }}", "", true},
+    }
+    for _, tt := range tests {
+        tmpl, err := parseTemplate("ntfy.template", tt.text, defaultNtfyTemplate)
+        if (err != nil) != tt.wantErr {
+            t.Errorf("parseTemplate(%q) error = %v, want error %v", tt.text, err, tt.wantErr)
+            continue
+        }
+        if err != nil {
+            continue
+        }
+        got, err := renderTemplate(tmpl, sampleTemplateData.Image, sampleTemplateData.Description, sampleTemplateData.Feed)
+        if err != nil || got != tt.want {
+            t.Errorf("parseTemplate(%q) renders %q, %v, want %q", tt.text, got, err, tt.want)
+        }
+    }
+}
+
+func TestUsesImageDetails(t *testing.T) {
+    tests := []struct {
+        text string
+        want bool
+    }{
+        {defaultMatrixTemplate, true},
+        {defaultMatrixHTMLTemplate, true},
+        {defaultMastodonTemplate, true},
+        {defaultNtfyTemplate, false},
+        {defaultGotifyTemplate, true},
+        {"{{ .Image.URL }} ({{ .Image.Resolution }})\n{{ .Description }}", false},
+        {"by {{ .Image.Uploader.Username }}", true},
+        {"{{ join (tagNames .Image) \", \" }}", true},
+        {"{{ if .Image.Tags }}tagged{{ end }}", true},
+    }
+    for _, tt := range tests {
+        tmpl, err := parseTemplate("test", tt.text, "")
+        if err != nil {
+            t.Fatal(err)
+        }
+        if got := usesImageDetails(tmpl); got != tt.want {
+            t.Errorf("usesImageDetails(%q) = %v, want %v", tt.text, got, tt.want)
+        }
+    }
+}
+
+func TestCompileTemplatesImageDetails(t *testing.T) {
+    tests := []struct {
+        name  string
+        setup func(cfg *Config)
+        want  bool
+    }{
+        {"nothing enabled", func(cfg *Config) {}, false},
+        {"default ntfy", func(cfg *Config) { cfg.Ntfy.Enabled = true }, false},
+        {"default webhook", func(cfg *Config) { cfg.Webhook.Enabled = true }, false},
+        {"ntfy with Wallhaven tags", func(cfg *Config) {
+            cfg.Ntfy.Enabled, cfg.Ntfy.WallhavenTags = true, true
+        }, true},
+        {"webhook with details", func(cfg *Config) {
+            cfg.Webhook.Enabled, cfg.Webhook.IncludeDetails = true, true
+        }, true},
+        {"ntfy template with the uploader", func(cfg *Config) {
+            cfg.Ntfy.Enabled, cfg.Ntfy.Template = true, "by {{ .Image.Uploader.Username }}"
+        }, true},
+        {"disabled ntfy with Wallhaven tags", func(cfg *Config) { cfg.Ntfy.WallhavenTags = true }, false},
+        {"default Mastodon status has hashtags", func(cfg *Config) { cfg.Mastodon.Enabled = true }, true},
+        {"Mastodon status without details", func(cfg *Config) {
+            cfg.Mastodon.Enabled, cfg.Mastodon.Template = true, "{{ .Image.URL }}"
+        }, false},
+        {"Matrix room caption with tags", func(cfg *Config) {
+            cfg.Matrix.Enabled, cfg.Matrix.Caption = true, "{{ .Image.URL }}"
+            cfg.Matrix.Rooms = []MatrixRoomConfig{{Room: "!room:example.org", Caption: "{{ join (tagNames .Image) \" \" }}"}}
+        }, true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            cfg := &Config{}
+            tt.setup(cfg)
+            if err := cfg.compileTemplates(); err != nil {
+                t.Fatal(err)
+            }
+            if cfg.Templates.ImageDetails != tt.want {
+                t.Errorf("ImageDetails = %v, want %v", cfg.Templates.ImageDetails, tt.want)
+            }
+            // Without a blocklist that decides whether /w/:id is called
+            if got := needsImageDetails(cfg, newTestDatabase(t)); got != tt.want {
+                t.Errorf("needsImageDetails = %v, want %v", got, tt.want)
+            }
+        })
+    }
+}
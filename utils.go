@@ -1,33 +1,153 @@
 package main
 
 import (
+    "fmt"
     "image"
+    "image/jpeg"
     "io"
+    "log/slog"
+    "math"
     "net/http"
     "os"
+    "strings"
 
     "github.com/disintegration/imaging"
 )
 
-func DownloadToTempFile(url string, prefix string) (string, error) {
-    resp, err := http.Get(url)
+const (
+    // maxDownloadSize caps downloads whose size Wallhaven didn't report
+    maxDownloadSize = 64 * 1024 * 1024
+    // downloadAttempts is how often an interrupted download is resumed
+    downloadAttempts = 3
+)
+
+// imageExtensions maps sniffed content types to file extensions. Only formats
+// that can be decoded for thumbnails are accepted.
+var imageExtensions = map[string]string{
+    "image/jpeg": ".jpg",
+    "image/png":  ".png",
+    "image/gif":  ".gif",
+}
+
+// DownloadToTempFile downloads an image to a temp file and returns its path.
+// The response must be an image (or untyped) and no larger than expectedSize,
+// if known, or maxDownloadSize; a known size must match exactly. Interrupted
+// downloads are resumed with Range requests. The extension comes from the
+// sniffed format, not the URL.
+func DownloadToTempFile(url string, prefix string, expectedSize int64) (string, error) {
+    limit := int64(maxDownloadSize)
+    if expectedSize > 0 {
+        limit = expectedSize
+    }
+    tmpFile, err := os.CreateTemp("", prefix+"-*.part")
     if err != nil {
         return "", err
     }
-    defer resp.Body.Close()
+    partPath := tmpFile.Name()
+    fail := func(err error) (string, error) {
+        tmpFile.Close()
+        os.Remove(partPath)
+        return "", err
+    }
 
-    tmpFile, err := os.CreateTemp("", prefix+"-*.jpg")
-    if err != nil {
+    var written int64
+    for attempt := 1; ; attempt++ {
+        n, permanent, err := downloadRange(url, tmpFile, written, limit)
+        written += n
+        if err == nil {
+            break
+        }
+        if permanent || attempt >= downloadAttempts {
+            return fail(err)
+        }
+        slog.Warn("Download interrupted, resuming", "url", url, "have", humanFileSize(int(written)), "attempt", attempt, "error", err)
+    }
+    if expectedSize > 0 && written != expectedSize {
+        return fail(fmt.Errorf("downloaded %d bytes, expected %d", written, expectedSize))
+    }
+
+    head := make([]byte, 512)
+    n, err := tmpFile.ReadAt(head, 0)
+    if err != nil && err != io.EOF {
+        return fail(err)
+    }
+    contentType := http.DetectContentType(head[:n])
+    ext, ok := imageExtensions[contentType]
+    if !ok {
+        return fail(fmt.Errorf("downloaded file is %s, not a supported image", contentType))
+    }
+    if err := tmpFile.Close(); err != nil {
+        os.Remove(partPath)
         return "", err
     }
-    defer tmpFile.Close()
+    finalPath := strings.TrimSuffix(partPath, ".part") + ext
+    if err := os.Rename(partPath, finalPath); err != nil {
+        os.Remove(partPath)
+        return "", err
+    }
+    return finalPath, nil
+}
 
-    _, err = io.Copy(tmpFile, resp.Body)
+// downloadRange writes the body of url from byte offset on to f and returns
+// how much the file grew, which is negative if the server ignored the Range
+// header and the file was started over. permanent is set for errors that
+// retrying won't fix, like a 404 or an oversized file.
+func downloadRange(url string, f *os.File, offset, limit int64) (written int64, permanent bool, err error) {
+    req, err := http.NewRequest("GET", url, nil)
     if err != nil {
-        os.Remove(tmpFile.Name())
-        return "", err
+        return 0, true, err
     }
-    return tmpFile.Name(), nil
+    if offset > 0 {
+        req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+    }
+    resp, err := doRequest("download", req, nil)
+    if err != nil {
+        return 0, false, err
+    }
+    defer resp.Body.Close()
+
+    switch {
+    case resp.StatusCode == http.StatusPartialContent && offset > 0:
+        var start int64
+        if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-", &start); err != nil || start != offset {
+            return 0, true, fmt.Errorf("unexpected Content-Range %q for offset %d", resp.Header.Get("Content-Range"), offset)
+        }
+    case resp.StatusCode == http.StatusOK:
+        if offset > 0 {
+            // The server ignored the Range header, so start over
+            if err := f.Truncate(0); err != nil {
+                return 0, true, err
+            }
+            written, offset = -offset, 0
+        }
+    default:
+        return 0, resp.StatusCode < 500, fmt.Errorf("HTTP %d: %s", resp.StatusCode, resp.Status)
+    }
+    if contentType := resp.Header.Get("Content-Type"); contentType != "" &&
+        !strings.HasPrefix(contentType, "image/") && !strings.HasPrefix(contentType, "application/octet-stream") {
+        return written, true, fmt.Errorf("unexpected Content-Type %q", contentType)
+    }
+    if resp.ContentLength > 0 && offset+resp.ContentLength > limit {
+        return written, true, fmt.Errorf("image is %s, over the %s limit", humanFileSize(int(offset+resp.ContentLength)), humanFileSize(int(limit)))
+    }
+
+    if _, err := f.Seek(offset, io.SeekStart); err != nil {
+        return written, true, err
+    }
+    // Read one byte past the limit to tell a full file from an oversized one
+    n, err := io.Copy(f, io.LimitReader(resp.Body, limit-offset+1))
+    downloadBytes.Add(float64(n))
+    written += n
+    if offset+n > limit {
+        return written, true, fmt.Errorf("image is over the %s limit", humanFileSize(int(limit)))
+    }
+    if err != nil {
+        return written, false, err
+    }
+    if resp.ContentLength > 0 && n != resp.ContentLength {
+        return written, false, fmt.Errorf("connection closed after %d of %d bytes", n, resp.ContentLength)
+    }
+    return written, false, nil
 }
 
 // CreateThumbnailMax800 reads the image at sourcePath, resizes it so the longest
@@ -57,3 +177,133 @@ func CreateThumbnailMax800(sourcePath string) (thumbPath string, err error) {
     }
     return tmpFile.Name(), nil
 }
+
+// containsString reports whether s is in list.
+func containsString(list []string, s string) bool {
+    for _, v := range list {
+        if v == s {
+            return true
+        }
+    }
+    return false
+}
+
+// minFallbackPixels stops the downscaling fallback from producing tiny images.
+const minFallbackPixels = 1_000_000
+
+// FitImageFile checks the image's file size and, if maxPixels > 0, its pixel
+// count, and resizes/compresses it if needed. Returns the path to use: the
+// original file if it already fits, otherwise a JPEG temp file the caller
+// should remove.
+func FitImageFile(path string, maxBytes int64, maxPixels int, prefix string) (string, error) {
+    fileInfo, err := os.Stat(path)
+    if err != nil {
+        return "", err
+    }
+    img, err := imaging.Open(path)
+    if err != nil {
+        return "", err
+    }
+    bounds := img.Bounds()
+    width, height := bounds.Dx(), bounds.Dy()
+    pixels := width * height
+    if fileInfo.Size() <= maxBytes && (maxPixels <= 0 || pixels <= maxPixels) {
+        // Already compliant
+        return path, nil
+    }
+
+    // Resize if needed
+    if maxPixels > 0 && pixels > maxPixels {
+        factor := math.Sqrt(float64(maxPixels) / float64(pixels))
+        newW := int(float64(width) * factor)
+        newH := int(float64(height) * factor)
+        img = imaging.Resize(img, newW, newH, imaging.Lanczos)
+    }
+
+    return encodeJPEGWithin(img, maxBytes, prefix)
+}
+
+// ShrinkImageFile returns path if the file is within maxBytes, otherwise a
+// recompressed and, if that isn't enough, progressively downscaled JPEG
+// variant that the caller should remove. The original is decoded once and
+// every smaller size is made from it in memory.
+func ShrinkImageFile(path string, maxBytes int64, prefix string) (string, error) {
+    fileInfo, err := os.Stat(path)
+    if err != nil {
+        return "", err
+    }
+    if fileInfo.Size() <= maxBytes {
+        return path, nil
+    }
+    img, err := imaging.Open(path)
+    if err != nil {
+        return "", err
+    }
+    bounds := img.Bounds()
+    width, height := bounds.Dx(), bounds.Dy()
+    pixels := width * height
+
+    // First try recompressing at full resolution, then halve the pixel count each round
+    for budget := pixels; ; budget /= 2 {
+        candidate := img
+        if budget < pixels {
+            factor := math.Sqrt(float64(budget) / float64(pixels))
+            candidate = imaging.Resize(img, int(float64(width)*factor), int(float64(height)*factor), imaging.Lanczos)
+        }
+        variant, err := encodeJPEGWithin(candidate, maxBytes, prefix)
+        if err == nil {
+            return variant, nil
+        }
+        if budget/2 < minFallbackPixels {
+            return "", err
+        }
+    }
+}
+
+// encodeJPEGWithin saves img as a JPEG temp file of at most maxBytes.
+func encodeJPEGWithin(img image.Image, maxBytes int64, prefix string) (string, error) {
+    // Save to temp file with compression (start at quality 85 and retry down to 60 if still too big)
+    tmpFile, err := os.CreateTemp("", prefix+"-*.jpg")
+    if err != nil {
+        return "", err
+    }
+    defer tmpFile.Close()
+
+    quality := 85
+    for quality >= 60 {
+        tmpFile.Seek(0, 0)
+        tmpFile.Truncate(0)
+        err = jpeg.Encode(tmpFile, img, &jpeg.Options{Quality: quality})
+        if err != nil {
+            os.Remove(tmpFile.Name())
+            return "", err
+        }
+        stat, _ := tmpFile.Stat()
+        if stat.Size() <= maxBytes {
+            return tmpFile.Name(), nil
+        }
+        quality -= 10
+    }
+
+    // If still too big at quality 60, fail
+    os.Remove(tmpFile.Name())
+    return "", fmt.Errorf("unable to reduce image to %s, even after resizing and compression", humanFileSize(int(maxBytes)))
+}
+
+// copyFile copies src to dst, replacing dst if it exists.
+func copyFile(src, dst string) error {
+    in, err := os.Open(src)
+    if err != nil {
+        return err
+    }
+    defer in.Close()
+    out, err := os.Create(dst)
+    if err != nil {
+        return err
+    }
+    if _, err := io.Copy(out, in); err != nil {
+        out.Close()
+        return err
+    }
+    return out.Close()
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+func TestDownloadRange(t *testing.T) {
+    if err := setupHTTPClient(&Config{}); err != nil {
+        t.Fatal(err)
+    }
+    const body = "0123456789"
+    // serve answers Range requests unless ignoreRange is set
+    serve := func(ignoreRange bool) http.HandlerFunc {
+        return func(w http.ResponseWriter, r *http.Request) {
+            w.Header().Set("Content-Type", "image/jpeg")
+            var start int
+            if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-", &start); err == nil && !ignoreRange {
+                w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(body)-1, len(body)))
+                w.WriteHeader(http.StatusPartialContent)
+            } else {
+                start = 0
+            }
+            w.Write([]byte(body[start:]))
+        }
+    }
+    tests := []struct {
+        name          string
+        handler       http.HandlerFunc
+        have          string // Already downloaded
+        limit         int64
+        wantWritten   int64
+        wantFile      string
+        wantErr       bool
+        wantPermanent bool
+    }{
+        {name: "whole file", handler: serve(false), limit: 100, wantWritten: 10, wantFile: body},
+        {name: "resumed", handler: serve(false), have: "0123", limit: 100, wantWritten: 6, wantFile: body},
+        {name: "range ignored", handler: serve(true), have: "0123", limit: 100, wantWritten: 6, wantFile: body},
+        {name: "exactly the limit", handler: serve(false), limit: 10, wantWritten: 10, wantFile: body},
+        {
+            name: "wrong Content-Range",
+            handler: func(w http.ResponseWriter, r *http.Request) {
+                w.Header().Set("Content-Range", "bytes 2-9/10")
+                w.WriteHeader(http.StatusPartialContent)
+                w.Write([]byte(body[2:]))
+            },
+            have: "0123", limit: 100, wantFile: "0123", wantErr: true, wantPermanent: true,
+        },
+        {
+            name:    "not found",
+            handler: func(w http.ResponseWriter, r *http.Request) { http.NotFound(w, r) },
+            limit:   100, wantErr: true, wantPermanent: true,
+        },
+        {
+            name: "server error",
+            handler: func(w http.ResponseWriter, r *http.Request) {
+                w.Header().Set("Retry-After", "0")
+                w.WriteHeader(http.StatusInternalServerError)
+            },
+            limit: 100, wantErr: true,
+        },
+        {
+            name: "error page",
+            handler: func(w http.ResponseWriter, r *http.Request) {
+                w.Header().Set("Content-Type", "text/html; charset=utf-8")
+                w.Write([]byte("<html>maintenance</html>"))
+            },
+            limit: 100, wantErr: true, wantPermanent: true,
+        },
+        {name: "Content-Length over the limit", handler: serve(false), limit: 5, wantErr: true, wantPermanent: true},
+        {
+            name: "body over the limit",
+            handler: func(w http.ResponseWriter, r *http.Request) {
+                w.Header().Set("Content-Type", "image/jpeg")
+                w.Write([]byte(body[:5]))
+                w.(http.Flusher).Flush() // Chunked, so there is no Content-Length
+                w.Write([]byte(body[5:]))
+            },
+            limit: 5, wantWritten: 6, wantFile: body[:6], wantErr: true, wantPermanent: true,
+        },
+        {
+            name: "connection closed early",
+            handler: func(w http.ResponseWriter, r *http.Request) {
+                w.Header().Set("Content-Type", "image/jpeg")
+                w.Header().Set("Content-Length", "10")
+                w.Write([]byte(body[:4]))
+            },
+            limit: 100, wantWritten: 4, wantFile: body[:4], wantErr: true,
+        },
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            server := httptest.NewServer(tt.handler)
+            defer server.Close()
+            f, err := os.Create(filepath.Join(t.TempDir(), "download.part"))
+            if err != nil {
+                t.Fatal(err)
+            }
+            defer f.Close()
+            if _, err := f.WriteString(tt.have); err != nil {
+                t.Fatal(err)
+            }
+
+            written, permanent, err := downloadRange(server.URL, f, int64(len(tt.have)), tt.limit)
+            if (err != nil) != tt.wantErr || permanent != tt.wantPermanent {
+                t.Fatalf("downloadRange error = %v, permanent %v, want error %v, permanent %v", err, permanent, tt.wantErr, tt.wantPermanent)
+            }
+            if written != tt.wantWritten {
+                t.Errorf("written = %d, want %d", written, tt.wantWritten)
+            }
+            if tt.wantFile == "" {
+                tt.wantFile = tt.have
+            }
+            data, err := os.ReadFile(f.Name())
+            if err != nil {
+                t.Fatal(err)
+            }
+            if string(data) != tt.wantFile {
+                t.Errorf("file = %q, want %q", data, tt.wantFile)
+            }
+        })
+    }
+}
+
+func TestDownloadToTempFile(t *testing.T) {
+    if err := setupHTTPClient(&Config{}); err != nil {
+        t.Fatal(err)
+    }
+    png := "\x89PNG\r\n\x1a\n" + strings.Repeat("\x00", 24)
+    tests := []struct {
+        name         string
+        body         string
+        expectedSize int64
+        wantExt      string // Empty if the download must fail
+    }{
+        {"PNG behind a .jpg URL", png, int64(len(png)), ".png"},
+        {"JPEG of unknown size", "\xff\xd8\xff\xe0" + strings.Repeat("\x00", 20), 0, ".jpg"},
+        {"WebP can't be thumbnailed", "RIFF\x00\x00\x00\x00WEBPVP8 " + strings.Repeat("\x00", 20), 0, ""},
+        {"not an image", "just some text", 0, ""},
+        {"smaller than expected", png, int64(len(png)) + 1, ""},
+        {"larger than expected", png, int64(len(png)) - 1, ""},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                w.Write([]byte(tt.body))
+            }))
+            defer server.Close()
+
+            path, err := DownloadToTempFile(server.URL+"/image.jpg", "test-download", tt.expectedSize)
+            if tt.wantExt == "" {
+                if err == nil {
+                    os.Remove(path)
+                    t.Fatalf("DownloadToTempFile = %s, want an error", path)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatal(err)
+            }
+            defer os.Remove(path)
+            if ext := filepath.Ext(path); ext != tt.wantExt {
+                t.Errorf("extension = %q, want %q", ext, tt.wantExt)
+            }
+            if data, err := os.ReadFile(path); err != nil || string(data) != tt.body {
+                t.Errorf("file = %q, %v, want %q", data, err, tt.body)
+            }
+        })
+    }
+}
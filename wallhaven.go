@@ -2,42 +2,22 @@ package main
 
 import (
         "encoding/json"
+        "errors"
         "fmt"
-        "io/ioutil"
-        "log"
+        "log/slog"
         "net/http"
+        "net/url"
         "strconv"
-        "sync"
         "time"
 )
 
-// Rate limiter for Wallhaven API calls
-var wallhavenRateLimiter = struct {
-        mu       sync.Mutex
-        lastCall time.Time
-        minDelay time.Duration
-}{
-        minDelay: 500 * time.Millisecond, // Minimum 500ms between API calls
-}
-
-// waitForRateLimit ensures we don't exceed Wallhaven API rate limits
-func waitForRateLimit() {
-        wallhavenRateLimiter.mu.Lock()
-        defer wallhavenRateLimiter.mu.Unlock()
-        
-        elapsed := time.Since(wallhavenRateLimiter.lastCall)
-        if elapsed < wallhavenRateLimiter.minDelay {
-                time.Sleep(wallhavenRateLimiter.minDelay - elapsed)
-        }
-        wallhavenRateLimiter.lastCall = time.Now()
-}
-
 type WallhavenImage struct {
         ID        string   `json:"id"`
         URL       string   `json:"url"`
         Uploader  struct {
                 Username string `json:"username"`
         } `json:"uploader"`
+        Purity     string   `json:"purity"`
         Resolution string   `json:"resolution"`
         FileSize   int      `json:"file_size"`
         FileType   string   `json:"file_type"`
@@ -48,18 +28,53 @@ type WallhavenImage struct {
                 Small    string `json:"small"`
         } `json:"thumbs"`
         Tags []struct {
+                ID   int    `json:"id"`
                 Name string `json:"name"`
         } `json:"tags"`
 }
 
+// wallhavenTagURL links to the wallhaven page listing wallpapers with the tag.
+func wallhavenTagURL(tagID int, name string) string {
+        if tagID > 0 {
+                return fmt.Sprintf("https://wallhaven.cc/tag/%d", tagID)
+        }
+        return "https://wallhaven.cc/search?q=" + url.QueryEscape(name)
+}
+
 type WallhavenImageResponse struct {
         Data WallhavenImage `json:"data"`
 }
 
+// WallhavenSearchResponse holds search results. They have every field of
+// WallhavenImage except the uploader and tags, which only /w/:id returns.
 type WallhavenSearchResponse struct {
-        Data []struct {
-                ID string `json:"id"`
-        } `json:"data"`
+        Data []WallhavenImage `json:"data"`
+}
+
+// hasDetails reports whether img came from /w/:id: search results have no
+// tags list at all, while the image endpoint always sends one, maybe empty.
+func (img WallhavenImage) hasDetails() bool {
+        return img.Tags != nil
+}
+
+// needsImageDetails reports whether the uploader or tags are used, by an
+// enabled destination or to check the tag blocklist.
+func needsImageDetails(cfg *Config, db *Database) bool {
+        if cfg.Templates.ImageDetails {
+                return true
+        }
+        blocked, err := db.BlockedTags()
+        return err != nil || len(blocked) > 0
+}
+
+// imageDetails returns img with its uploader and tags, fetching them from
+// /w/:id only if they are missing and needed. Search results are enough
+// otherwise, which saves an API call per image.
+func imageDetails(cfg *Config, db *Database, img WallhavenImage) (WallhavenImage, error) {
+        if img.hasDetails() || !needsImageDetails(cfg, db) {
+                return img, nil
+        }
+        return FetchWallhavenImage(cfg, img.ID)
 }
 
 // RateLimitInfo holds rate limit information from response headers
@@ -84,181 +99,145 @@ func ParseRateLimitHeaders(resp *http.Response) RateLimitInfo {
         return info
 }
 
-// CalculateAdaptiveDelay calculates delay based on remaining rate limit
-// Returns delay in seconds
-func CalculateAdaptiveDelay(remaining, limit int) int {
-        if limit == 0 {
-                // If we don't know the limit, use default
-                return 1
-        }
-        
-        // Calculate percentage remaining
-        percentage := float64(remaining) / float64(limit)
-        
-        switch {
-        case percentage > 0.66: // > 66% remaining
-                return 1 // Fast when plenty of quota
-        case percentage > 0.33: // 33-66% remaining
-                return 2 // Slightly slower
-        case percentage > 0.20: // 20-33% remaining
-                return 5 // Moderate slowdown
-        case percentage > 0.10: // 10-20% remaining
-                return 10 // Significant slowdown
-        case percentage > 0.05: // 5-10% remaining
-                return 20 // Very slow
-        default: // < 5% remaining
-                return 45 // Very conservative
-        }
+// wallhavenStatusError is an unsuccessful Wallhaven API response.
+type wallhavenStatusError struct {
+        StatusCode int
+        Status     string
 }
 
-// Rate limiting helper functions
-func handleRateLimit(resp *http.Response) error {
-        if resp.StatusCode == 429 {
-                retryAfter := resp.Header.Get("Retry-After")
-                if retryAfter != "" {
-                        if seconds, err := strconv.Atoi(retryAfter); err == nil {
-                                log.Printf("Rate limited. Waiting %d seconds before retry...", seconds)
-                                time.Sleep(time.Duration(seconds) * time.Second)
-                                return nil
-                        }
-                }
-                // Default wait time if Retry-After header is missing or invalid
-                log.Printf("Rate limited. Waiting 60 seconds before retry...")
-                time.Sleep(60 * time.Second)
-                return nil
-        }
-        return fmt.Errorf("HTTP %d: %s", resp.StatusCode, resp.Status)
+func (e *wallhavenStatusError) Error() string {
+        return fmt.Sprintf("HTTP %d: %s", e.StatusCode, e.Status)
 }
 
-func makeRateLimitedRequest(req *http.Request, client *http.Client, maxRetries int) (*http.Response, error) {
-        for attempt := 0; attempt < maxRetries; attempt++ {
-                resp, err := client.Do(req)
-                if err != nil {
-                        return nil, err
-                }
-                
-                if resp.StatusCode == 429 {
-                        if err := handleRateLimit(resp); err != nil {
-                                resp.Body.Close()
-                                return nil, err
-                        }
-                        resp.Body.Close()
-                        log.Printf("Retrying request (attempt %d/%d)...", attempt+1, maxRetries)
-                        continue
+// isWallhavenGone reports whether the API said the requested wallpaper doesn't
+// exist (anymore), so asking again can't help.
+func isWallhavenGone(err error) bool {
+        var statusErr *wallhavenStatusError
+        return errors.As(err, &statusErr) && (statusErr.StatusCode == http.StatusNotFound || statusErr.StatusCode == http.StatusGone)
+}
+
+// makeRateLimitedRequest sends a Wallhaven API request through the shared HTTP
+// layer, which waits for wallhavenLimiter and retries rate-limited requests
+// after Retry-After, and records metrics for every attempt.
+func makeRateLimitedRequest(req *http.Request, endpoint string) (*http.Response, error) {
+        start := time.Now()
+        defer func() {
+                wallhavenRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds())
+        }()
+        resp, err := doRequest("wallhaven", req, func(resp *http.Response) {
+                observeWallhavenResponse(endpoint, resp)
+                if resp == nil {
+                        return
                 }
-                
-                if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-                        return resp, nil
+                wallhavenLimiter.Update(ParseRateLimitHeaders(resp))
+                if resp.StatusCode == http.StatusTooManyRequests {
+                        health.backoff(rateLimitDelay(resp))
                 }
-                
+        })
+        if err != nil {
+                return nil, err
+        }
+        // 304 only answers the conditional requests of cachedWallhavenGet
+        if (resp.StatusCode < 200 || resp.StatusCode >= 300) && resp.StatusCode != http.StatusNotModified {
                 resp.Body.Close()
-                if attempt == maxRetries-1 {
-                        return nil, fmt.Errorf("HTTP %d after %d attempts: %s", resp.StatusCode, maxRetries, resp.Status)
-                }
-                
-                log.Printf("HTTP %d, retrying in 5 seconds (attempt %d/%d)...", resp.StatusCode, attempt+1, maxRetries)
-                time.Sleep(5 * time.Second)
+                return nil, &wallhavenStatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+        }
+        return resp, nil
+}
+
+// setWallhavenHeaders sets the User-Agent and, if configured, the API key. The
+// key goes in the X-API-Key header so it never ends up in a logged URL.
+func setWallhavenHeaders(cfg *Config, req *http.Request) {
+        if cfg.Wallhaven.UserAgent != "" {
+                req.Header.Set("User-Agent", cfg.Wallhaven.UserAgent)
+        }
+        if cfg.Wallhaven.APIToken != "" {
+                req.Header.Set("X-API-Key", cfg.Wallhaven.APIToken)
         }
-        
-        return nil, fmt.Errorf("max retries exceeded")
 }
 
-// FetchNewWallhavenImageIDs returns only the image IDs that need to be processed (not already sent)
-func (cfg *Config) FetchNewWallhavenImageIDs(db *Database, toprange string) ([]string, RateLimitInfo, error) {
-        api := fmt.Sprintf(
-                "https://wallhaven.cc/api/v1/search?apikey=%s&categories=%s&purity=%s&sorting=%s&topRange=%s&order=%s",
-                cfg.Wallhaven.APIToken,
-                cfg.Wallhaven.Categories,
-                cfg.Wallhaven.Purity,
-                cfg.Wallhaven.Sorting,
-                toprange,
-                cfg.Wallhaven.Order,
-        )
-        if cfg.Debug {
-                log.Printf("Search API URL: %v", api)
+// SearchWallhaven runs a search with the given query parameters (the API key is
+// added here) and returns the results in order, without uploader and tags.
+func SearchWallhaven(cfg *Config, params url.Values) ([]WallhavenImage, error) {
+        api := "https://wallhaven.cc/api/v1/search?" + params.Encode()
+        slog.Debug("Search API request", "url", api)
+        ttl := cfg.cacheTTL("search")
+        if params.Get("sorting") == "random" {
+                ttl = 0 // A cached random search would keep returning the same images
         }
-        req, _ := http.NewRequest("GET", api, nil)
-        req.Header.Set("User-Agent", cfg.Wallhaven.UserAgent)
-        client := &http.Client{Timeout: 15 * time.Second}
         
-        // Use rate-limited request with retries
-        resp, err := makeRateLimitedRequest(req, client, 3)
+        // Use rate-limited request with retries, or the cache
+        body, err := cachedWallhavenGet(cfg, "search", api, ttl)
         if err != nil {
-                return nil, RateLimitInfo{}, err
+                return nil, err
         }
-        defer resp.Body.Close()
-        body, _ := ioutil.ReadAll(resp.Body)
-        
-        // Parse rate limit info from headers
-        rateLimitInfo := ParseRateLimitHeaders(resp)
         
         // Lightweight debug logging (avoid dumping full headers/body)
-        if cfg.Debug {
-                log.Printf("Search API Response Status: %d (rate limit remaining %d/%d)",
-                        resp.StatusCode, rateLimitInfo.Remaining, rateLimitInfo.Limit)
-        }
+        slog.Debug("Search API response", "bytes", len(body))
         
         var searchRes WallhavenSearchResponse
         if err := json.Unmarshal(body, &searchRes); err != nil {
-                log.Printf("JSON unmarshal error: %v", err)
-                return nil, rateLimitInfo, err
+                slog.Error("Search API JSON unmarshal error", "error", err)
+                return nil, err
+        }
+        return searchRes.Data, nil
+}
+
+// FetchNewWallhavenImages returns only the search results that need to be processed (not already sent)
+func (cfg *Config) FetchNewWallhavenImages(db *Database, toprange string) ([]WallhavenImage, error) {
+        params := url.Values{}
+        params.Set("categories", cfg.Wallhaven.Categories)
+        params.Set("purity", cfg.Wallhaven.Purity)
+        params.Set("sorting", cfg.Wallhaven.Sorting)
+        params.Set("topRange", toprange)
+        params.Set("order", cfg.Wallhaven.Order)
+        results, err := SearchWallhaven(cfg, params)
+        if err != nil {
+                return nil, err
         }
 
-        log.Printf("Search returned %d image IDs to check", len(searchRes.Data))
-        var imageIDs []string
+        slog.Debug("Search returned images to check", "toprange", toprange, "count", len(results))
+        var images []WallhavenImage
         skippedCount := 0
-        for idx, img := range searchRes.Data {
-                if idx > 0 && idx%10 == 0 {
-                        log.Printf("Progress: Checked %d/%d search results (%d new images, %d already sent)", 
-                                idx, len(searchRes.Data), len(imageIDs), skippedCount)
-                }
+        for _, img := range results {
                 sent, err := db.IsSent(img.ID)
+                if err == nil && !sent {
+                        sent, err = db.IsQueued(img.ID)
+                }
                 if err != nil {
-                        log.Printf("DB error for image %s: %v", img.ID, err)
+                        slog.Error("DB error", "image_id", img.ID, "error", err)
                         skippedCount++
                         continue
                 }
                 if sent {
-                        // Skip silently - already sent
+                        // Skip silently - already sent or waiting in the outbox
                         skippedCount++
                         continue
                 }
-                imageIDs = append(imageIDs, img.ID)
+                images = append(images, img)
         }
-        log.Printf("Found %d new images to process (skipped %d already sent)", len(imageIDs), skippedCount)
-        return imageIDs, rateLimitInfo, nil
+        slog.Info("Found new images", "toprange", toprange, "new", len(images), "skipped", skippedCount)
+        imagesFetched.WithLabelValues(toprange).Add(float64(len(images)))
+        return images, nil
 }
 
 func FetchWallhavenImage(cfg *Config, id string) (WallhavenImage, error) {
-        // Rate limit: ensure we don't make too many requests too quickly
-        waitForRateLimit()
+        api := "https://wallhaven.cc/api/v1/w/" + url.PathEscape(id)
+        slog.Debug("Image API request", "url", api)
         
-        api := fmt.Sprintf("https://wallhaven.cc/api/v1/w/%s?apikey=%s", id, cfg.Wallhaven.APIToken)
-        if cfg.Debug {
-                log.Printf("Image API URL: %v", api)
-        }
-        req, _ := http.NewRequest("GET", api, nil)
-        req.Header.Set("User-Agent", cfg.Wallhaven.UserAgent)
-        client := &http.Client{Timeout: 10 * time.Second}
-        
-        // Use rate-limited request with retries
-        resp, err := makeRateLimitedRequest(req, client, 3)
+        // Use rate-limited request with retries, or the cache
+        body, err := cachedWallhavenGet(cfg, "image", api, cfg.cacheTTL("image"))
         if err != nil {
-                log.Printf("Image url: %v", api)
-                log.Printf("Request failed: %v", err)
+                slog.Error("Image API request failed", "url", api, "error", err)
                 return WallhavenImage{}, err
         }
-        defer resp.Body.Close()
-        body, _ := ioutil.ReadAll(resp.Body)
         
         // Lightweight debug logging (avoid dumping full headers/body)
-        if cfg.Debug {
-                log.Printf("Image API Response Status: %d", resp.StatusCode)
-        }
+        slog.Debug("Image API response", "image_id", id, "bytes", len(body))
         
         var imgRes WallhavenImageResponse
         if err := json.Unmarshal(body, &imgRes); err != nil {
-                log.Printf("Not sending image %s: JSON unmarshal error: %v", id, err)
+                slog.Error("Image API JSON unmarshal error", "image_id", id, "error", err)
                 return WallhavenImage{}, err
         }
         return imgRes.Data, nil
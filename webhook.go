@@ -0,0 +1,154 @@
+package main
+
+import (
+    "bytes"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "io"
+    "log/slog"
+    "net/http"
+    "os"
+    "path"
+    "path/filepath"
+    "strings"
+    "time"
+)
+
+// WebhookPayload is the JSON document POSTed to the webhook for every new image.
+type WebhookPayload struct {
+    ID          string            `json:"id"`
+    URL         string            `json:"url"`
+    Path        string            `json:"path"`
+    Feed        string            `json:"feed"`
+    Purity      string            `json:"purity"`
+    Resolution  string            `json:"resolution"`
+    FileType    string            `json:"file_type"`
+    FileSize    int               `json:"file_size"`
+    Uploader    string            `json:"uploader"` // Empty unless include_details is set
+    Tags        []string          `json:"tags"`     // Empty unless include_details is set
+    Description string            `json:"description"`
+    Thumbs      map[string]string `json:"thumbs"`
+    Variants    map[string]string `json:"variants,omitempty"` // Copies served by our HTTP server
+}
+
+// SendWebhook POSTs a WebhookPayload to the configured URL, signed with
+// X-Wallhaven-Daily-Signature (sha256=<hex HMAC of the body>) if a secret is set.
+func SendWebhook(cfg *Config, img WallhavenImage, feed, aiDescription, imagePath, thumbPath string) error {
+    var uploader string
+    var tags []string
+    if cfg.Webhook.IncludeDetails {
+        uploader = img.Uploader.Username
+        for _, tag := range img.Tags {
+            tags = append(tags, tag.Name)
+        }
+    }
+    payload := WebhookPayload{
+        ID:          img.ID,
+        URL:         img.URL,
+        Path:        img.Path,
+        Feed:        feed,
+        Purity:      img.Purity,
+        Resolution:  img.Resolution,
+        FileType:    img.FileType,
+        FileSize:    img.FileSize,
+        Uploader:    uploader,
+        Tags:        tags,
+        Description: strings.TrimSpace(aiDescription),
+        Thumbs: map[string]string{
+            "original": img.Thumbs.Original,
+            "large":    img.Thumbs.Large,
+            "small":    img.Thumbs.Small,
+        },
+    }
+    if variants, err := publishVariants(cfg, img, imagePath, thumbPath); err != nil {
+        slog.Warn("Webhook: could not publish local variants", "image_id", img.ID, "error", err)
+    } else {
+        payload.Variants = variants
+    }
+
+    body, err := json.Marshal(payload)
+    if err != nil {
+        return err
+    }
+    req, err := http.NewRequest("POST", cfg.Webhook.URL, bytes.NewReader(body))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    if cfg.Webhook.Secret != "" {
+        mac := hmac.New(sha256.New, []byte(cfg.Webhook.Secret))
+        mac.Write(body)
+        req.Header.Set("X-Wallhaven-Daily-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+    }
+    resp, err := doRequest("webhook", req, nil)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode >= 300 {
+        b, _ := io.ReadAll(resp.Body)
+        return fmt.Errorf("webhook failed: %s - %s", resp.Status, string(b))
+    }
+    return nil
+}
+
+// publishVariants copies the downloaded image and our thumbnail into the
+// variants directory and returns their public URLs. Returns nil if variants
+// aren't configured.
+func publishVariants(cfg *Config, img WallhavenImage, imagePath, thumbPath string) (map[string]string, error) {
+    dir := cfg.Webhook.VariantsDir
+    if dir == "" || cfg.HTTP.PublicURL == "" {
+        return nil, nil
+    }
+    if err := os.MkdirAll(dir, 0755); err != nil {
+        return nil, err
+    }
+    originalName := img.ID + path.Ext(img.Path)
+    thumbName := img.ID + "-thumb.jpg"
+    if err := copyFile(imagePath, filepath.Join(dir, originalName)); err != nil {
+        return nil, err
+    }
+    if err := copyFile(thumbPath, filepath.Join(dir, thumbName)); err != nil {
+        return nil, err
+    }
+    base := strings.TrimSuffix(cfg.HTTP.PublicURL, "/") + "/variants/"
+    return map[string]string{
+        "original":  base + originalName,
+        "thumbnail": base + thumbName,
+    }, nil
+}
+
+// VariantsHandler serves files from the variants directory, without directory listings.
+func VariantsHandler(dir string) http.Handler {
+    files := http.StripPrefix("/variants/", http.FileServer(http.Dir(dir)))
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if strings.HasSuffix(r.URL.Path, "/") {
+            http.NotFound(w, r)
+            return
+        }
+        files.ServeHTTP(w, r)
+    })
+}
+
+// PruneVariants periodically removes published variants older than ttl.
+func PruneVariants(dir string, ttl time.Duration) {
+    for {
+        entries, err := os.ReadDir(dir)
+        if err != nil && !os.IsNotExist(err) {
+            slog.Error("Webhook: could not list variants", "error", err)
+        }
+        for _, entry := range entries {
+            info, err := entry.Info()
+            if err != nil || entry.IsDir() || time.Since(info.ModTime()) < ttl {
+                continue
+            }
+            if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil {
+                slog.Error("Webhook: could not remove variant", "file", entry.Name(), "error", err)
+            }
+        }
+        time.Sleep(time.Hour)
+    }
+}